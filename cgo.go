@@ -0,0 +1,47 @@
+package main
+
+import (
+	"go/ast"
+	"sort"
+	"strconv"
+)
+
+// cgoTypes are the C numeric types which cgo provides to any file importing C, whatever its preamble.
+var cgoTypes = map[string]bool{
+	"char": true, "schar": true, "uchar": true,
+	"short": true, "ushort": true, "int": true, "uint": true,
+	"long": true, "ulong": true, "longlong": true, "ulonglong": true,
+	"float": true, "double": true, "complexfloat": true, "complexdouble": true,
+}
+
+// importsC reports whether f imports the pseudo-package C of cgo.
+func importsC(f *ast.File) bool {
+	for _, spec := range f.Imports {
+		if path, err := strconv.Unquote(spec.Path.Value); err == nil && path == "C" {
+			return true
+		}
+	}
+	return false
+}
+
+// preambleRefs returns the names referred to as C.name by the signature of fdecl which the preamble of its file may declare,
+// which another file cannot refer to.
+func preambleRefs(fdecl *ast.FuncDecl) []string {
+	seen := make(map[string]bool)
+	for _, node := range signature(fdecl) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Name == "C" && !cgoTypes[sel.Sel.Name] {
+					seen["C."+sel.Sel.Name] = true
+				}
+			}
+			return true
+		})
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// paramComments returns the comment groups of f, whose source is src, in the parameters and results of the function of t,
+// without those of the context parameter, which is not declared by the wrapper.
+// The comments before the comma following a parameter belong to it, as do the trailing comments on the line of the comma.
+func paramComments(fset *token.FileSet, f *ast.File, src []byte, t *target) []*ast.CommentGroup {
+	ftype := t.decl.Type
+	params := ftype.Params.List
+	ctx := findContext(params, t.imports, t.ctxPointer)
+	var comments []*ast.CommentGroup
+	for _, c := range f.Comments {
+		if ftype.Params.Opening < c.Pos() && c.End() <= ftype.End() {
+			comments = append(comments, c)
+		}
+	}
+	// A field declaring several names is kept without its first name.
+	if ctx < 0 || len(params[ctx].Names) > 1 {
+		return comments
+	}
+
+	tokFile := fset.File(ftype.Pos())
+	line := func(pos token.Pos) int { return tokFile.Line(pos) }
+	// comma returns the position of the comma between lo and hi outside the comments, or token.NoPos.
+	comma := func(lo, hi token.Pos) token.Pos {
+		for pos := lo; pos < hi; pos++ {
+			inComment := false
+			for _, c := range comments {
+				if c.Pos() <= pos && pos < c.End() {
+					inComment = true
+				}
+			}
+			if !inComment && src[tokFile.Offset(pos)] == ',' {
+				return pos
+			}
+		}
+		return token.NoPos
+	}
+	// trailing reports whether c follows the comma on its line and the next field starts on another line.
+	trailing := func(c *ast.CommentGroup, comma, next token.Pos) bool {
+		return comma.IsValid() && line(c.Pos()) == line(comma) && line(next) != line(comma)
+	}
+
+	field := params[ctx]
+	start, end := ftype.Params.Opening, ftype.Params.Closing
+	var prevComma token.Pos
+	if ctx > 0 {
+		start = params[ctx-1].End()
+		prevComma = comma(start, field.Pos())
+	}
+	if ctx+1 < len(params) {
+		end = params[ctx+1].Pos()
+	}
+	nextComma := comma(field.End(), end)
+
+	kept := comments[:0]
+	for _, c := range comments {
+		owned := false
+		switch {
+		case c.Pos() < start || end < c.End():
+		case c.End() <= field.Pos():
+			owned = ctx == 0 || prevComma.IsValid() && c.Pos() > prevComma && !trailing(c, prevComma, field.Pos())
+		case c.Pos() < field.End():
+			owned = true
+		default:
+			owned = !nextComma.IsValid() || c.Pos() < nextComma || trailing(c, nextComma, end)
+		}
+		if !owned {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+const directivePrefix = "//nocontext:"
+
+// directives returns the values of the //nocontext:key=value comments in doc by key.
+func directives(doc *ast.CommentGroup) map[string]string {
+	if doc == nil {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, c := range doc.List {
+		if !strings.HasPrefix(c.Text, directivePrefix) {
+			continue
+		}
+		kv := strings.TrimSpace(strings.TrimPrefix(c.Text, directivePrefix))
+		key, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			key, value = kv[:i], kv[i+1:]
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// readDirectives applies the //nocontext: directives in the doc comment of the function of t.
+//
+//	//nocontext:ctx=appContext()
+//
+// overrides the context expression for the function, and
+//
+//	//nocontext:argorder=2,1
+//
+// declares the parameters of the wrapper in another order, where each number is the position
+// of the parameter of the function, from 1 and without the context.
+func (t *target) readDirectives(fset *token.FileSet) error {
+	values := directives(t.decl.Doc)
+	if src, ok := values["ctx"]; ok {
+		names, err := parseCtxExpr(src)
+		if err != nil {
+			return fmt.Errorf("%s: %s: invalid //nocontext:ctx: %w", fset.Position(t.decl.Pos()), t.decl.Name.Name, err)
+		}
+		t.ctxExpr = src
+		t.ctxQualifiers = names
+	}
+	if src, ok := values["argorder"]; ok {
+		order, err := parseArgOrder(src, t.stripContext())
+		if err != nil {
+			return fmt.Errorf("%s: %s: invalid //nocontext:argorder: %w", fset.Position(t.decl.Pos()), t.decl.Name.Name, err)
+		}
+		t.argOrder = order
+	}
+	return nil
+}
+
+// parseArgOrder parses the permutation of params given by //nocontext:argorder.
+// A variadic parameter must stay the last one.
+func parseArgOrder(src string, params []*ast.Field) ([]int, error) {
+	n := countParams(params)
+	var order []int
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(src, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a position", strings.TrimSpace(item))
+		}
+		if i < 1 || i > n {
+			return nil, fmt.Errorf("position %d is out of the %d parameters", i, n)
+		}
+		if seen[i] {
+			return nil, fmt.Errorf("position %d is given twice", i)
+		}
+		seen[i] = true
+		order = append(order, i)
+	}
+	if len(order) != n {
+		return nil, fmt.Errorf("%d positions are given for %d parameters", len(order), n)
+	}
+	if len(params) > 0 {
+		if _, ok := params[len(params)-1].Type.(*ast.Ellipsis); ok && order[n-1] != n {
+			return nil, fmt.Errorf("the variadic parameter must be the last one")
+		}
+	}
+	return order, nil
+}
+
+// reorderParams returns params declaring one parameter per field in order, as given by parseArgOrder.
+// The positions are cleared, since they would be out of order.
+func reorderParams(params []*ast.Field, order []int) []*ast.Field {
+	var flat []*ast.Field
+	for _, param := range params {
+		for _, name := range param.Names {
+			flat = append(flat, &ast.Field{Names: []*ast.Ident{name}, Type: param.Type})
+		}
+	}
+	reordered := make([]*ast.Field, len(order))
+	for i, j := range order {
+		reordered[i] = flat[j-1]
+		resetPos(reordered[i])
+	}
+	return reordered
+}
+
+// configPrefix starts the comment configuring the generation for a whole file.
+const configPrefix = directivePrefix + "config"
+
+// fileConfig returns opts overridden by the //nocontext:config comment anywhere in f, such as
+//
+//	//nocontext:config suffix=Ctx ctx=todo
+//
+// suffix sets the name suffix of the functions to be wrapped, and ctx the context expression,
+// where todo and background stand for context.TODO() and context.Background().
+// The settings are separated by spaces, so an expression cannot contain spaces.
+func fileConfig(fset *token.FileSet, f *ast.File, opts Options) (Options, error) {
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			rest := strings.TrimPrefix(c.Text, configPrefix)
+			if rest == c.Text || rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+				continue
+			}
+			for _, kv := range strings.Fields(rest) {
+				i := strings.Index(kv, "=")
+				if i < 0 {
+					return opts, fmt.Errorf("%s: invalid //nocontext:config: %q is not key=value", fset.Position(c.Pos()), kv)
+				}
+				key, value := kv[:i], kv[i+1:]
+				switch key {
+				case "suffix":
+					if !token.IsIdentifier("X" + value) {
+						return opts, fmt.Errorf("%s: invalid //nocontext:config: suffix %q is not a valid identifier suffix", fset.Position(c.Pos()), value)
+					}
+					opts.Suffix = value
+				case "ctx":
+					switch value {
+					case "todo":
+						value = "context.TODO()"
+					case "background":
+						value = "context.Background()"
+					}
+					names, err := parseCtxExpr(value)
+					if err != nil {
+						return opts, fmt.Errorf("%s: invalid //nocontext:config: ctx: %w", fset.Position(c.Pos()), err)
+					}
+					opts.CtxExpr, opts.ctxQualifiers = value, names
+				default:
+					return opts, fmt.Errorf("%s: invalid //nocontext:config: unknown key %q", fset.Position(c.Pos()), key)
+				}
+			}
+		}
+	}
+	return opts, nil
+}
+
+// parseCtxExpr validates the context expression src and returns the package qualifiers it refers to.
+func parseCtxExpr(src string) ([]string, error) {
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	return qualifiers(expr), nil
+}
+
+// contextExpr returns the context expression src for a wrapper, or context.Background() if src is empty.
+func contextExpr(src string, names stdNames) (ast.Expr, error) {
+	if src == "" {
+		return &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: ast.NewIdent(names.context), Sel: ast.NewIdent("Background")},
+			Args: []ast.Expr{},
+		}, nil
+	}
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	resetPos(expr)
+	renameQualifier(contextPath, names.context, expr)
+	return expr, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/types"
+	"strings"
+)
+
+// testOutput returns the path of the compile test of the output at path, e.g. foo_nocontext_test.go.
+func testOutput(path string) string {
+	return strings.TrimSuffix(path, ".go") + "_test.go"
+}
+
+// wrapperRef returns an expression referring to the generated wrapper fdecl,
+// which is a method expression for a method, or "" if it cannot be referred to without instantiation.
+func wrapperRef(fdecl *ast.FuncDecl) string {
+	if fdecl.Type.TypeParams != nil || hasTypeParams(fdecl) {
+		return ""
+	}
+	if fdecl.Recv == nil {
+		return fdecl.Name.Name
+	}
+	recv := types.ExprString(fdecl.Recv.List[0].Type)
+	if strings.HasPrefix(recv, "*") {
+		recv = "(" + recv + ")"
+	}
+	return recv + "." + fdecl.Name.Name
+}
+
+// generateTest renders a test file of the package of out referring to each wrapper generated by generate,
+// so that go test fails to compile when the wrappers are broken.
+func generateTest(out *output, opts Options) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeHeader(&buf, opts); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "package %s\n", out.pkgName)
+	var refs []string
+	for _, t := range out.targets {
+		if ref := wrapperRef(t.decl); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) > 0 {
+		buf.WriteString("\nvar (\n")
+		for _, ref := range refs {
+			fmt.Fprintf(&buf, "\t_ = %s\n", ref)
+		}
+		buf.WriteString(")\n")
+	}
+	return format.Source(buf.Bytes())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs the git command with args in dir and returns its standard output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return string(out), nil
+}
+
+// changedFiles returns the absolute paths of the files changed in the git repository containing dir,
+// which are the staged files if base is empty, or the files changed since the merge base of base and HEAD otherwise.
+func changedFiles(dir, base string) (map[string]bool, error) {
+	top, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"diff", "--name-only", "--cached"}
+	if base != "" {
+		args = []string{"diff", "--name-only", base + "...HEAD"}
+	}
+	out, err := git(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[string]bool)
+	for _, name := range strings.Split(out, "\n") {
+		if name != "" {
+			changed[filepath.Join(strings.TrimSpace(top), filepath.FromSlash(name))] = true
+		}
+	}
+	return changed, nil
+}
+
+// filterChanged returns the paths of fileNames in changed, comparing them with the symbolic links resolved,
+// since git reports the real path of the repository.
+func filterChanged(fileNames []string, changed map[string]bool) []string {
+	var kept []string
+	for _, fpath := range fileNames {
+		real, err := filepath.EvalSymlinks(fpath)
+		if err != nil {
+			continue
+		}
+		if abs, err := filepath.Abs(real); err == nil && changed[abs] {
+			kept = append(kept, fpath)
+		}
+	}
+	return kept
+}
@@ -1,3 +1,10 @@
 module github.com/orisano/nocontext
 
-go 1.15
+go 1.18
+
+require golang.org/x/tools v0.12.0
+
+require (
+	golang.org/x/mod v0.12.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+)
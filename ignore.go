@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const ignoreFileName = ".nocontextignore"
+
+type ignorePattern struct {
+	pattern string
+	dirOnly bool
+}
+
+// ignoreList is a list of glob patterns read from .nocontextignore.
+//
+// A pattern containing a slash is matched against the whole path relative to the root,
+// otherwise against the name of each file and directory visited. A trailing slash matches directories only.
+// Blank lines and lines starting with # are ignored.
+type ignoreList []ignorePattern
+
+// readIgnoreFile reads the ignore patterns from the file name. A missing file yields no patterns.
+func readIgnoreFile(name string) (ignoreList, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open ignore file: %w", err)
+	}
+	defer f.Close()
+
+	var list ignoreList
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{pattern: strings.TrimPrefix(line, "/")}
+		if strings.HasSuffix(p.pattern, "/") {
+			p.pattern = strings.TrimSuffix(p.pattern, "/")
+			p.dirOnly = true
+		}
+		if _, err := path.Match(p.pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q: %w", name, line, err)
+		}
+		list = append(list, p)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read ignore file: %w", err)
+	}
+	return list, nil
+}
+
+// match reports whether the slash-separated path rel relative to the root is ignored.
+func (l ignoreList) match(rel string, isDir bool) bool {
+	for _, p := range l {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if strings.Contains(p.pattern, "/") {
+			if ok, _ := path.Match(p.pattern, rel); ok {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p.pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
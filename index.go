@@ -0,0 +1,110 @@
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"log"
+)
+
+// declIndex records the declarations of a package to detect the wrappers colliding with them.
+type declIndex struct {
+	// names are the package-level identifiers.
+	names map[string]bool
+	// methods are the method names by receiver base type name.
+	methods map[string]map[string]bool
+	// vars are the package-level variables.
+	vars map[string]bool
+}
+
+func newDeclIndex() *declIndex {
+	return &declIndex{names: make(map[string]bool), methods: make(map[string]map[string]bool), vars: make(map[string]bool)}
+}
+
+// add records the top-level declarations of f.
+func (idx *declIndex) add(f *ast.File) {
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			idx.addFunc(recvTypeName(decl), decl.Name.Name)
+		case *ast.GenDecl:
+			if decl.Tok == token.IMPORT {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					idx.names[spec.Name.Name] = true
+				case *ast.ValueSpec:
+					for _, name := range spec.Names {
+						idx.names[name.Name] = true
+						idx.vars[name.Name] = decl.Tok == token.VAR
+					}
+				}
+			}
+		}
+	}
+}
+
+// declared reports whether name is declared as a method of the receiver type recv,
+// or at the package level if recv is empty.
+func (idx *declIndex) declared(recv, name string) bool {
+	if recv == "" {
+		return idx.names[name]
+	}
+	return idx.methods[recv][name]
+}
+
+// skipCollisions removes the targets whose wrappers cannot be declared with their names, are already declared
+// in their packages, or would be generated twice. The indexes are keyed by the package directories.
+// The collisions are reported unless quiet is set, in which case they are logged only if verbose.
+func skipCollisions(outputs []*output, indexes map[string]*declIndex, opts Options, quiet bool) {
+	generated := make(map[string]*declIndex)
+	for _, out := range outputs {
+		idx := indexes[out.dir]
+		gen := generated[out.dir]
+		if gen == nil {
+			gen = newDeclIndex()
+			generated[out.dir] = gen
+		}
+		targets := out.targets[:0]
+		for _, t := range out.targets {
+			recv, name := t.wrapperRecv(opts), t.wrapperName(opts)
+			// The functions and the methods of each receiver type are told apart, e.g. Fetch and Client.Fetch.
+			wrapped := qualifiedName(t.recvTypeName(), t.decl.Name.Name)
+			switch reason := t.invalidName(opts); {
+			case reason != "":
+				log.Printf("%s: skip %s: %s", out.displayPath(), wrapped, reason)
+			case idx != nil && idx.declared(recv, name):
+				if !quiet || opts.Verbose {
+					log.Printf("%s: skip %s: %s is already declared", out.displayPath(), wrapped, qualifiedName(recv, name))
+				}
+			case gen.declared(recv, name):
+				log.Printf("%s: skip %s: %s is generated twice", out.displayPath(), wrapped, qualifiedName(recv, name))
+			default:
+				gen.addFunc(recv, name)
+				targets = append(targets, t)
+			}
+		}
+		out.targets = targets
+	}
+}
+
+// addFunc records a method of the receiver type recv, or a function if recv is empty.
+func (idx *declIndex) addFunc(recv, name string) {
+	if recv == "" {
+		idx.names[name] = true
+		return
+	}
+	if idx.methods[recv] == nil {
+		idx.methods[recv] = make(map[string]bool)
+	}
+	idx.methods[recv][name] = true
+}
+
+// qualifiedName returns name, preceded by the receiver type recv for a method.
+func qualifiedName(recv, name string) string {
+	if recv == "" {
+		return name
+	}
+	return recv + "." + name
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+)
+
+// suffixViolations returns the exported functions of f, a file with imports, violating the naming convention of suffix:
+// those taking a context.Context first without the suffix, and those with the suffix taking no context at all.
+func suffixViolations(fset *token.FileSet, f *ast.File, imports map[string]importSpec, suffix string) []string {
+	var violations []string
+	for _, decl := range f.Decls {
+		fdecl, ok := decl.(*ast.FuncDecl)
+		if !ok || !fdecl.Name.IsExported() {
+			continue
+		}
+		name := fdecl.Name.Name
+		if recv := recvTypeName(fdecl); recv != "" {
+			name = recv + "." + name
+		}
+		params := fdecl.Type.Params.List
+		suffixed := strings.HasSuffix(fdecl.Name.Name, suffix) && fdecl.Name.Name != suffix
+		var reason string
+		switch {
+		case !suffixed && len(params) > 0 && (findContext(params[:1], imports, false) == 0 || findContext(params[:1], imports, true) == 0):
+			reason = "takes a context first but is not named with " + suffix
+		case suffixed && !hasContextParam(fdecl, imports):
+			reason = "is named with " + suffix + " but takes no context"
+		default:
+			continue
+		}
+		violations = append(violations, fmt.Sprintf("%s: %s %s", fset.Position(fdecl.Pos()), name, reason))
+	}
+	return violations
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// listFunctions writes a table of the functions which wrappers are generated for, without generating them.
+func listFunctions(w io.Writer, fset *token.FileSet, targets []*target, opts Options) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "FILE\tRECEIVER\tNAME\tPARAMS\tTYPES"); err != nil {
+		return err
+	}
+	for _, t := range targets {
+		var recv string
+		if t.decl.Recv != nil {
+			recv = types.ExprString(t.decl.Recv.List[0].Type)
+		}
+		params := t.decl.Type.Params.List
+		if !opts.Reverse {
+			params = t.stripContext()
+		}
+		paramTypes := make([]string, 0, countParams(params))
+		for _, param := range params {
+			n := len(param.Names)
+			if n == 0 {
+				n = 1
+			}
+			for i := 0; i < n; i++ {
+				paramTypes = append(paramTypes, types.ExprString(param.Type))
+			}
+		}
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", fset.Position(t.decl.Pos()), recv, t.decl.Name.Name, len(paramTypes), strings.Join(paramTypes, ", ")); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// allTargets returns the targets of outputs in order.
+func allTargets(outputs []*output) []*target {
+	var targets []*target
+	for _, out := range outputs {
+		targets = append(targets, out.targets...)
+	}
+	return targets
+}
@@ -1,80 +1,1812 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/ast"
+	"go/build/constraint"
+	"go/format"
 	"go/parser"
 	"go/printer"
 	"go/token"
-	"io"
+	"go/types"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/imports"
 )
 
-func parseFile(path string) (*ast.File, error) {
-	f, err := os.Open(path)
+const header = "// Code generated by nocontext. DO NOT EDIT."
+
+const contextPath = "context"
+
+// isGenerated reports whether src starts with the header of the generated files.
+func isGenerated(src []byte) bool {
+	return bytes.HasPrefix(src, []byte(header+"\n"))
+}
+
+// parseFile parses the source file at path without object resolution, which the wrappers do not need,
+// and returns it with its source.
+// The comments are parsed only if comments is set or the file contains a //nocontext: directive, since nothing else reads them.
+// If suffix is not empty, a file containing neither suffix nor a directive is parsed up to its package clause only,
+// since none of its functions can be wrapped. The syntax errors after the package clause of such a file
+// are not reported then, and are left to the compiler.
+func parseFile(fset *token.FileSet, path string, comments bool, suffix string) (*ast.File, []byte, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open file: %w", err)
+	}
+	mode := parser.SkipObjectResolution
+	hasDirective := bytes.Contains(src, []byte(directivePrefix))
+	if comments || hasDirective {
+		mode |= parser.ParseComments
+	}
+	if suffix != "" && !hasDirective && !bytes.Contains(src, []byte(suffix)) {
+		mode |= parser.PackageClauseOnly
+	}
+	f, err := parser.ParseFile(fset, path, src, mode)
+	return f, src, err
+}
+
+// importName returns the package name assumed for an import path without an explicit name.
+func importName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = elems[len(elems)-2]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	if i := strings.IndexAny(name, ".-"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+type importSpec struct {
+	path     string
+	explicit bool
+	// reason describes the feature which requires the import in the generated file.
+	reason string
+}
+
+// fileImports maps the qualifiers usable in f to the imported packages.
+func fileImports(f *ast.File) map[string]importSpec {
+	imports := make(map[string]importSpec)
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if spec.Name == nil {
+			imports[importName(path)] = importSpec{path: path}
+			continue
+		}
+		if spec.Name.Name == "." {
+			imports[dotImport(path)] = importSpec{path: path}
+			continue
+		}
+		if spec.Name.Name == "_" {
+			continue
+		}
+		imports[spec.Name.Name] = importSpec{path: path, explicit: true}
+	}
+	return imports
+}
+
+// dotImport returns the key of the package path imported with a dot in the imports of a file,
+// which is no qualifier, so that it never collides with one.
+func dotImport(path string) string {
+	return "." + path
+}
+
+// contextTypes are the exported types of the context package, which a file importing it with a dot refers to unqualified.
+var contextTypes = map[string]bool{"Context": true, "CancelFunc": true, "CancelCauseFunc": true}
+
+// qualifyDotContext qualifies the types of the context package referred to unqualified in the signature of t,
+// whose file imports the package with a dot, by qualifier, since the generated file imports it by name.
+func (t *target) qualifyDotContext(qualifier string) {
+	if _, ok := t.imports[dotImport(contextPath)]; !ok {
+		return
+	}
+	mapSignature(t.decl, func(ident *ast.Ident) ast.Expr {
+		if !contextTypes[ident.Name] {
+			return ident
+		}
+		return &ast.SelectorExpr{X: ast.NewIdent(qualifier), Sel: ident}
+	})
+	// The context parameter is still found by its qualified type.
+	imports := make(map[string]importSpec, len(t.imports)+1)
+	for name, spec := range t.imports {
+		imports[name] = spec
+	}
+	imports[qualifier] = importSpec{path: contextPath, explicit: qualifier != contextPath}
+	t.imports = imports
+}
+
+// Options configures the generation.
+type Options struct {
+	// Suffix is the name suffix of the context-aware functions, e.g. WithContext.
+	// It is overridden by the //nocontext:config comment of each file.
+	Suffix string
+	// Reverse generates WithContext variants of the functions without a context parameter.
+	Reverse bool
+	// Sort orders the wrappers by "source" position or by "name".
+	Sort string
+	// Timeout bounds the context passed by the wrappers, if positive.
+	Timeout time.Duration
+	// BuildTags is the build constraint placed on the generated files, if not nil.
+	BuildTags constraint.Expr
+	// LegacyTags adds the // +build lines matching BuildTags for older toolchains.
+	LegacyTags bool
+	// CtxExpr is the context expression passed by the wrappers, context.Background() if empty.
+	// It is overridden by the //nocontext:config comment of each file and the //nocontext:ctx= directive of each function.
+	CtxExpr       string
+	ctxQualifiers []string
+	// WrapExpr is the template of the expression evaluated by the wrappers instead of the plain call.
+	// See expandWrapExpr for the placeholders.
+	WrapExpr string
+	// wrapQualifiers are the package qualifiers referred to by WrapExpr.
+	wrapQualifiers []string
+	// DeprecateStmt is the template of the statements the wrappers run first, e.g. to record a deprecation.
+	// See parseDeprecateStmt for the placeholders.
+	DeprecateStmt string
+	// deprecateQualifiers are the package qualifiers referred to by DeprecateStmt.
+	deprecateQualifiers []string
+	// Deprecated marks the wrappers as deprecated in favor of the wrapped functions in their doc comments.
+	Deprecated bool
+	// Verbose logs the decisions made during the generation.
+	Verbose bool
+	// Include and Exclude filter the functions to be wrapped by their names, if not nil.
+	Include, Exclude *regexp.Regexp
+	// Funcs restricts the functions to be wrapped to the listed names if not nil, ignoring Include and Exclude.
+	Funcs map[string]bool
+	// MethodsAsFuncs generates package-level functions taking the receiver as the first parameter
+	// instead of method wrappers. See target.wrapperName for the names.
+	MethodsAsFuncs bool
+	// CtxPointer wraps the functions taking a *context.Context, passing the address of a fresh context variable.
+	CtxPointer bool
+	// ParamComments keeps the comments in the parameter lists of the wrapped functions.
+	ParamComments bool
+	// Passthrough keeps the context parameter in the wrappers, which ignore it and pass the context expression anyway.
+	// It is meant as a temporary aid for the migration to contexts.
+	Passthrough bool
+	// NoFormat writes the printer output as is, without gofmt, to debug the generation.
+	NoFormat bool
+	// FormatTool formats the generated files with goimports if "goimports", and with gofmt otherwise.
+	FormatTool string
+	// Visibility forces the wrapper names to be "exported" or "unexported" if not empty or "inherit".
+	Visibility string
+	// GroupByReceiver groups the wrappers by receiver type, separating the groups by blank lines.
+	GroupByReceiver bool
+	// RequireError restricts the functions to be wrapped to the ones returning an error as the last result.
+	RequireError bool
+	// TrimImports removes the imports which the generated code does not use.
+	TrimImports bool
+	// PackageDoc is the package doc comment placed on one generated file per package, if not empty.
+	PackageDoc string
+	// ExplicitErr makes the wrappers of the functions returning an error as the last result return it from an if statement.
+	ExplicitErr bool
+	// Registry is the package-level map variable which an init function stores the wrappers into by name,
+	// if not empty. The methods are not registered.
+	Registry string
+}
+
+// returnsError reports whether the last result of fdecl is of type error.
+func returnsError(fdecl *ast.FuncDecl) bool {
+	results := fdecl.Type.Results
+	if results == nil || len(results.List) == 0 {
+		return false
+	}
+	ident, ok := results.List[len(results.List)-1].Type.(*ast.Ident)
+	return ok && ident.Name == "error"
+}
+
+// selects reports whether the function name passes the Include and Exclude filters,
+// or whether it is listed in Funcs if specified.
+func (opts Options) selects(name string) bool {
+	if opts.Funcs != nil {
+		return opts.Funcs[name]
+	}
+	if opts.Include != nil && !opts.Include.MatchString(name) {
+		return false
+	}
+	return opts.Exclude == nil || !opts.Exclude.MatchString(name)
+}
+
+type target struct {
+	decl    *ast.FuncDecl
+	imports map[string]importSpec
+	// suffix is the name suffix of the context-aware functions, e.g. WithContext.
+	suffix string
+	// field is the name of the interface field whose method is wrapped by -promote, if not empty.
+	field string
+	// ctxPointer is set if the context parameter is a *context.Context, which is passed the address of a variable.
+	ctxPointer bool
+	// ctxExpr overrides Options.CtxExpr for the function if not empty.
+	ctxExpr       string
+	ctxQualifiers []string
+	// comments are the comment groups in the signature kept by -param-comments, without those of the context parameter.
+	comments []*ast.CommentGroup
+	// argOrder is the order of the parameters of the wrapper given by //nocontext:argorder, if not nil.
+	argOrder []int
+	// recvCtx is the method of the receiver returning the context passed by the method wrapper, if not empty.
+	recvCtx string
+}
+
+// detach returns a copy of fdecl without its body and object resolution,
+// so that the wrapper built from it does not keep the rest of the parsed file reachable.
+func detach(fdecl *ast.FuncDecl) *ast.FuncDecl {
+	decl := &ast.FuncDecl{Doc: fdecl.Doc, Recv: fdecl.Recv, Name: ast.NewIdent(fdecl.Name.Name), Type: fdecl.Type}
+	decl.Name.NamePos = fdecl.Name.NamePos
+	for _, node := range signature(decl) {
+		ast.Inspect(node, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok {
+				ident.Obj = nil
+			}
+			return true
+		})
+	}
+	return decl
+}
+
+// recvTypeName returns the base type name of the receiver of t, or "" for a function.
+func (t *target) recvTypeName() string {
+	return recvTypeName(t.decl)
+}
+
+// recvTypeName returns the base type name of the receiver of fdecl, or "" for a function.
+func recvTypeName(fdecl *ast.FuncDecl) string {
+	if fdecl.Recv == nil {
+		return ""
+	}
+	expr := fdecl.Recv.List[0].Type
+	for {
+		switch x := expr.(type) {
+		case *ast.ParenExpr:
+			expr = x.X
+		case *ast.StarExpr:
+			expr = x.X
+		case *ast.IndexExpr:
+			expr = x.X
+		case *ast.IndexListExpr:
+			expr = x.X
+		case *ast.Ident:
+			return x.Name
+		default:
+			return types.ExprString(expr)
+		}
+	}
+}
+
+// wrapperName returns the name of the wrapper generated from t.
+// The suffix is removed from the end of the function name only once, e.g. WithContext for WithContextWithContext.
+// With MethodsAsFuncs, the name of a method wrapper is preceded by the receiver type name,
+// e.g. ServerFoo for (*Server).FooWithContext.
+// The case of the initial is forced by Visibility.
+func (t *target) wrapperName(opts Options) string {
+	var name string
+	switch {
+	case opts.Reverse:
+		name = t.decl.Name.Name + t.suffix
+	case opts.MethodsAsFuncs:
+		name = t.recvTypeName() + strings.TrimSuffix(t.decl.Name.Name, t.suffix)
+	default:
+		name = strings.TrimSuffix(t.decl.Name.Name, t.suffix)
+	}
+	r, size := utf8.DecodeRuneInString(name)
+	switch opts.Visibility {
+	case "exported":
+		name = string(unicode.ToUpper(r)) + name[size:]
+	case "unexported":
+		name = string(unicode.ToLower(r)) + name[size:]
+	}
+	return name
+}
+
+// invalidName returns why the wrapper generated from t cannot be declared with its name, or "" if it can.
+// The names of the package-level functions must not shadow the predeclared identifiers either,
+// which the rest of the package would then fail to refer to.
+func (t *target) invalidName(opts Options) string {
+	name := t.wrapperName(opts)
+	function := t.wrapperRecv(opts) == ""
+	switch {
+	case token.IsKeyword(name):
+		return name + " is a keyword"
+	case function && types.Universe.Lookup(name) != nil:
+		return name + " is predeclared"
+	case function && name == "init":
+		return "init is reserved for the package initialization"
+	case opts.Visibility == "exported" && !token.IsExported(name):
+		return name + " cannot be exported"
+	}
+	return ""
+}
+
+// wrapperRecv returns the receiver type name of the wrapper generated from t, or "" for a function.
+func (t *target) wrapperRecv(opts Options) string {
+	if opts.MethodsAsFuncs {
+		return ""
+	}
+	return t.recvTypeName()
+}
+
+// hasTypeParams reports whether fdecl is a method of a generic type.
+func hasTypeParams(fdecl *ast.FuncDecl) bool {
+	if fdecl.Recv == nil {
+		return false
+	}
+	expr := fdecl.Recv.List[0].Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch expr.(type) {
+	case *ast.IndexExpr, *ast.IndexListExpr:
+		return true
+	}
+	return false
+}
+
+// sortTargets orders targets as specified by opts.Sort.
+// The source order is by the path of the file and then the position in it, whichever order the files were merged in,
+// followed by the methods synthesized by -promote, which have no position.
+// With GroupByReceiver, the functions come first and then the methods grouped by receiver type,
+// keeping the order within each group.
+func sortTargets(fset *token.FileSet, targets []*target, opts Options) {
+	sort.SliceStable(targets, func(i, j int) bool {
+		pi, pj := targets[i].decl.Pos(), targets[j].decl.Pos()
+		if !pi.IsValid() || !pj.IsValid() {
+			return pi.IsValid() && !pj.IsValid()
+		}
+		fi, fj := fset.Position(pi), fset.Position(pj)
+		if fi.Filename != fj.Filename {
+			return fi.Filename < fj.Filename
+		}
+		return fi.Offset < fj.Offset
+	})
+	if opts.GroupByReceiver {
+		sort.SliceStable(targets, func(i, j int) bool {
+			return targets[i].wrapperRecv(opts) < targets[j].wrapperRecv(opts)
+		})
+	}
+	if opts.Sort != "name" {
+		return
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		ri, rj := targets[i].wrapperRecv(opts), targets[j].wrapperRecv(opts)
+		if ri != rj {
+			return ri < rj
+		}
+		return targets[i].wrapperName(opts) < targets[j].wrapperName(opts)
+	})
+}
+
+// findContext returns the index of the first field of params of type context.Context in a file with imports,
+// or of type *context.Context if pointer is set. It returns -1 if there is none.
+func findContext(params []*ast.Field, imports map[string]importSpec, pointer bool) int {
+	for i, param := range params {
+		typ := param.Type
+		if pointer {
+			star, ok := typ.(*ast.StarExpr)
+			if !ok {
+				continue
+			}
+			typ = star.X
+		}
+		if isContextType(typ, imports) {
+			return i
+		}
+	}
+	return -1
+}
+
+// contextIndex returns the index of the field of the parameters of t declaring the context parameter,
+// which is the first one of type context.Context, or *context.Context for ctxPointer, or else 0.
+func (t *target) contextIndex() int {
+	if i := findContext(t.decl.Type.Params.List, t.imports, t.ctxPointer); i >= 0 {
+		return i
+	}
+	return 0
+}
+
+// stripContext returns params without the context parameter declared by the field i.
+// Only the first name is removed from a field declaring several names, e.g. (ctx, other context.Context).
+func stripContext(params []*ast.Field, i int) []*ast.Field {
+	if i >= len(params) {
+		return params
+	}
+	stripped := append([]*ast.Field(nil), params[:i]...)
+	if field := params[i]; len(field.Names) > 1 {
+		stripped = append(stripped, &ast.Field{Doc: field.Doc, Names: field.Names[1:], Type: field.Type, Tag: field.Tag, Comment: field.Comment})
+	}
+	return append(stripped, params[i+1:]...)
+}
+
+// stripContext returns the parameters of t without the context parameter.
+func (t *target) stripContext() []*ast.Field {
+	return stripContext(t.decl.Type.Params.List, t.contextIndex())
+}
+
+// contextArg returns the position of the context among the arguments forwarded to the function of t.
+func (t *target) contextArg() int {
+	return countParams(t.decl.Type.Params.List[:t.contextIndex()])
+}
+
+// countParams returns the number of parameters declared by params, counting an unnamed one as one.
+func countParams(params []*ast.Field) int {
+	n := 0
+	for _, param := range params {
+		if len(param.Names) == 0 {
+			n++
+		}
+		n += len(param.Names)
+	}
+	return n
+}
+
+// declares reports whether the function of t declares name in its function scope,
+// including the type parameters of the function and of its receiver.
+// If skipContext is set, the context parameter is not taken into account.
+func (t *target) declares(name string, skipContext bool) bool {
+	params := t.decl.Type.Params.List
+	if skipContext {
+		params = t.stripContext()
+	}
+	var recv, results []*ast.Field
+	if t.decl.Recv != nil {
+		recv = t.decl.Recv.List
+	}
+	if t.decl.Type.Results != nil {
+		results = t.decl.Type.Results.List
+	}
+	for _, list := range [][]*ast.Field{recv, params, results} {
+		for _, field := range list {
+			for _, ident := range field.Names {
+				if ident.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	return typeParamNames(t.decl.Type)[name] || recvTypeParams(t.decl)[name]
+}
+
+// recvTypeParams returns the names of the type parameters bound by the receiver of fdecl,
+// e.g. K and V for (*Cache[K, V]), which are in scope in the whole function.
+func recvTypeParams(fdecl *ast.FuncDecl) map[string]bool {
+	names := make(map[string]bool)
+	if fdecl.Recv == nil {
+		return names
+	}
+	expr := fdecl.Recv.List[0].Type
+	for {
+		switch x := expr.(type) {
+		case *ast.ParenExpr:
+			expr = x.X
+			continue
+		case *ast.StarExpr:
+			expr = x.X
+			continue
+		case *ast.IndexExpr:
+			if ident, ok := x.Index.(*ast.Ident); ok {
+				names[ident.Name] = true
+			}
+		case *ast.IndexListExpr:
+			for _, index := range x.Indices {
+				if ident, ok := index.(*ast.Ident); ok {
+					names[ident.Name] = true
+				}
+			}
+		}
+		return names
+	}
+}
+
+// signature returns the nodes of fdecl holding type expressions.
+func signature(fdecl *ast.FuncDecl) []ast.Node {
+	if fdecl.Recv == nil {
+		return []ast.Node{fdecl.Type}
+	}
+	return []ast.Node{fdecl.Recv, fdecl.Type}
+}
+
+// renameQualifier replaces the package qualifier from with to under nodes.
+func renameQualifier(from, to string, nodes ...ast.Node) {
+	for _, node := range nodes {
+		ast.Inspect(node, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok && x.Name == from {
+					x.Name = to
+				}
+			}
+			return true
+		})
+	}
+}
+
+// qualifiers returns the package qualifiers referenced under nodes.
+func qualifiers(nodes ...ast.Node) []string {
+	var names []string
+	for _, node := range nodes {
+		ast.Inspect(node, func(n ast.Node) bool {
+			if sel, ok := n.(*ast.SelectorExpr); ok {
+				if x, ok := sel.X.(*ast.Ident); ok {
+					names = append(names, x.Name)
+				}
+			}
+			return true
+		})
+	}
+	return names
+}
+
+// isContextType reports whether expr denotes context.Context in a file with imports,
+// which is a bare Context if the file imports context with a dot.
+func isContextType(expr ast.Expr, imports map[string]importSpec) bool {
+	if ident, ok := expr.(*ast.Ident); ok {
+		_, dot := imports[dotImport(contextPath)]
+		return dot && ident.Name == "Context"
+	}
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Context" {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	return ok && imports[x.Name].path == contextPath
+}
+
+// refersToContext reports whether the type expression expr refers to context.Context,
+// e.g. a callback of type func(context.Context) error.
+func refersToContext(expr ast.Expr, imports map[string]importSpec) bool {
+	found := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if e, ok := n.(ast.Expr); ok && isContextType(e, imports) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// hasContextParam reports whether fdecl takes a context.Context or *context.Context parameter.
+func hasContextParam(fdecl *ast.FuncDecl, imports map[string]importSpec) bool {
+	params := fdecl.Type.Params.List
+	return findContext(params, imports, false) >= 0 || findContext(params, imports, true) >= 0
+}
+
+// contextParam reports whether the context parameter of fdecl is a *context.Context, which is wrapped only if
+// ctxPointer is set, or else the reason why fdecl cannot be wrapped.
+func contextParam(fdecl *ast.FuncDecl, imports map[string]importSpec, ctxPointer bool) (pointer bool, reason string) {
+	params := fdecl.Type.Params.List
+	if len(params) == 0 {
+		return false, "it has no parameters, so it takes no context"
+	}
+	if findContext(params, imports, false) < 0 && findContext(params, imports, true) >= 0 {
+		if !ctxPointer {
+			return false, "the context parameter is a *context.Context, see -ctx-pointer"
+		}
+		return true, ""
+	}
+	// Without a context parameter, the first parameter is taken as the context, unless it merely refers to one.
+	if !hasContextParam(fdecl, imports) && refersToContext(params[0].Type, imports) {
+		return false, "the first parameter is not a context.Context but refers to it"
+	}
+	return false, ""
+}
+
+// callee returns the expression referring to the function name, selected from the receiver for methods.
+// A function is qualified by source, the qualifier of its package in another package, if not empty.
+func (t *target) callee(name, source string) ast.Expr {
+	if t.decl.Recv == nil {
+		if source != "" {
+			return &ast.SelectorExpr{X: ast.NewIdent(source), Sel: ast.NewIdent(name)}
+		}
+		return ast.NewIdent(name)
+	}
+	var x ast.Expr = ast.NewIdent(t.decl.Recv.List[0].Names[0].Name)
+	if t.field != "" {
+		x = &ast.SelectorExpr{X: x, Sel: ast.NewIdent(t.field)}
+	}
+	return &ast.SelectorExpr{X: x, Sel: ast.NewIdent(name)}
+}
+
+// wrapperBody returns a function body of ftype, which returns or evaluates call.
+func wrapperBody(ftype *ast.FuncType, call ast.Expr) *ast.BlockStmt {
+	var stmt ast.Stmt
+	if ftype.Results.NumFields() > 0 {
+		stmt = &ast.ReturnStmt{Results: []ast.Expr{call}}
+	} else {
+		stmt = &ast.ExprStmt{X: call}
+	}
+	return &ast.BlockStmt{List: []ast.Stmt{stmt}}
+}
+
+// explicitErrBody returns a function body of ftype, whose last result is an error, which returns the error of call
+// from an if statement and nil otherwise, for the linters requiring the errors to be handled explicitly.
+// The results of call are assigned to fresh variables, which must be chosen after the context parameter is removed.
+func (t *target) explicitErrBody(ftype *ast.FuncType, call ast.Expr) *ast.BlockStmt {
+	fresh := func(name string) *ast.Ident {
+		ident := name
+		for i := 1; t.declares(ident, false); i++ {
+			ident = name + strconv.Itoa(i)
+		}
+		return ast.NewIdent(ident)
+	}
+	n := countParams(ftype.Results.List)
+	vars := make([]ast.Expr, n)
+	for i := range vars[:n-1] {
+		vars[i] = fresh("r" + strconv.Itoa(i))
+	}
+	vars[n-1] = fresh("err")
+	errVar := vars[n-1].(*ast.Ident)
+	results := append([]ast.Expr{}, vars...)
+	results[n-1] = ast.NewIdent("nil")
+
+	assign := &ast.AssignStmt{Lhs: vars, Tok: token.DEFINE, Rhs: []ast.Expr{call}}
+	ifStmt := &ast.IfStmt{
+		Cond: &ast.BinaryExpr{X: ast.NewIdent(errVar.Name), Op: token.NEQ, Y: ast.NewIdent("nil")},
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{Results: vars}}},
+	}
+	if n == 1 {
+		// if err := FooWithContext(ctx); err != nil {
+		ifStmt.Init = assign
+		return &ast.BlockStmt{List: []ast.Stmt{ifStmt, &ast.ReturnStmt{Results: results}}}
+	}
+	return &ast.BlockStmt{List: []ast.Stmt{assign, ifStmt, &ast.ReturnStmt{Results: results}}}
+}
+
+// forwardArgs appends the names of params to the arguments of call, spreading a variadic parameter.
+// The arguments are fresh identifiers without the positions of the parameters, which would misplace the comments.
+// The arguments are allocated at once with a room for another one, e.g. the context.
+func forwardArgs(call *ast.CallExpr, params []*ast.Field) {
+	args := make([]ast.Expr, len(call.Args), len(call.Args)+countParams(params)+1)
+	copy(args, call.Args)
+	call.Args = args
+	for _, param := range params {
+		for _, name := range param.Names {
+			call.Args = append(call.Args, ast.NewIdent(name.Name))
+		}
+		if _, ok := param.Type.(*ast.Ellipsis); ok {
+			call.Ellipsis = 1
+		}
+	}
+}
+
+// stdNames holds the qualifiers of the standard packages referred to by the generated code,
+// and of the source package if it is generated into another one by -out-dir.
+type stdNames struct {
+	context, time string
+	source        string
+}
+
+// freshName returns name, or name followed by a number if t declares it already.
+func (t *target) freshName(name string) string {
+	fresh := name
+	for i := 1; t.declares(fresh, true); i++ {
+		fresh = name + strconv.Itoa(i)
+	}
+	return fresh
+}
+
+// nameRecv gives the receiver of t the lower-cased initial of its type name if it is blank or unnamed,
+// so that the method can be called on it.
+func (t *target) nameRecv() {
+	if t.decl.Recv == nil {
+		return
+	}
+	recv := t.decl.Recv.List[0]
+	if len(recv.Names) == 1 && recv.Names[0].Name != "_" {
+		return
+	}
+	r, _ := utf8.DecodeRuneInString(t.recvTypeName())
+	recv.Names = []*ast.Ident{ast.NewIdent(t.freshName(string(unicode.ToLower(r))))}
+}
+
+// nameParams gives synthesized names such as _arg0 to the blank and unnamed parameters,
+// so that they can be forwarded. The number is the position of the parameter in params.
+func (t *target) nameParams(params []*ast.Field) {
+	i := 0
+	for _, param := range params {
+		if len(param.Names) == 0 {
+			param.Names = []*ast.Ident{ast.NewIdent(t.freshName("_arg" + strconv.Itoa(i)))}
+			i++
+			continue
+		}
+		for _, name := range param.Names {
+			if name.Name == "_" {
+				name.Name = t.freshName("_arg" + strconv.Itoa(i))
+			}
+			i++
+		}
+	}
+}
+
+// durationExpr returns an expression of d using the largest unit dividing it, e.g. 5 * time.Second.
+func durationExpr(d time.Duration, timeName string) ast.Expr {
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"Hour", time.Hour},
+		{"Minute", time.Minute},
+		{"Second", time.Second},
+		{"Millisecond", time.Millisecond},
+		{"Microsecond", time.Microsecond},
+		{"Nanosecond", time.Nanosecond},
+	}
+	for _, unit := range units {
+		if d%unit.d != 0 {
+			continue
+		}
+		sel := &ast.SelectorExpr{X: ast.NewIdent(timeName), Sel: ast.NewIdent(unit.name)}
+		if d == unit.d {
+			return sel
+		}
+		n := &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(int64(d/unit.d), 10)}
+		return &ast.BinaryExpr{X: n, Op: token.MUL, Y: sel}
+	}
+	panic("unreachable")
+}
+
+func wrapperDecl(t *target, names stdNames, opts Options) (*ast.FuncDecl, error) {
+	fdecl := t.decl
+	t.qualifyDotContext(names.context)
+	name := fdecl.Name.Name
+	if len(fdecl.Type.Params.List) == 0 {
+		return nil, fmt.Errorf("%s: no context parameter", name)
+	}
+	fdecl.Name.Name = t.wrapperName(opts)
+
+	ctxSrc := opts.CtxExpr
+	if t.ctxExpr != "" {
+		ctxSrc = t.ctxExpr
+	}
+	ctxExpr, err := contextExpr(ctxSrc, names)
+	if err != nil {
+		return nil, fmt.Errorf("%s: context expression: %w", name, err)
+	}
+	// The receiver is named before the context expression calls the accessor on it.
+	t.nameRecv()
+	if t.recvCtx != "" {
+		ctxExpr = t.recvCtxExpr()
+	}
+	var stmts []ast.Stmt
+	if opts.Timeout > 0 {
+		// ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		// defer cancel()
+		ctxVar, cancelVar := t.freshName("ctx"), t.freshName("cancel")
+		stmts = append(stmts,
+			&ast.AssignStmt{
+				Lhs: []ast.Expr{ast.NewIdent(ctxVar), ast.NewIdent(cancelVar)},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.CallExpr{
+					Fun:  &ast.SelectorExpr{X: ast.NewIdent(names.context), Sel: ast.NewIdent("WithTimeout")},
+					Args: []ast.Expr{ctxExpr, durationExpr(opts.Timeout, names.time)},
+				}},
+			},
+			&ast.DeferStmt{Call: &ast.CallExpr{Fun: ast.NewIdent(cancelVar)}},
+		)
+		ctxExpr = ast.NewIdent(ctxVar)
+	}
+	if t.ctxPointer {
+		// ctx := context.Background()
+		// FooWithContext(&ctx)
+		// The variable of -timeout is reused.
+		if opts.Timeout <= 0 {
+			ctxVar := ast.NewIdent(t.freshName("ctx"))
+			stmts = append(stmts, &ast.AssignStmt{Lhs: []ast.Expr{ctxVar}, Tok: token.DEFINE, Rhs: []ast.Expr{ctxExpr}})
+			ctxExpr = ctxVar
+		}
+		ctxExpr = &ast.UnaryExpr{Op: token.AND, X: ctxExpr}
+	}
+	// The context parameter is found in the original signature, before the names are given and the qualifiers renamed.
+	params, ctxArg := t.stripContext(), t.contextArg()
+	allParams, ctxField := fdecl.Type.Params.List, fdecl.Type.Params.List[t.contextIndex()]
+	ctxEnd, nextPos := ctxField.End(), fdecl.Type.Params.Closing
+	if i := t.contextIndex() + 1; i < len(allParams) {
+		nextPos = allParams[i].Pos()
+	}
+	t.nameParams(params)
+	fdecl.Type.Params.List = params
+
+	for qualifier, spec := range t.imports {
+		if spec.path == contextPath && qualifier != names.context {
+			renameQualifier(qualifier, names.context, signature(fdecl)...)
+			if opts.Passthrough {
+				renameQualifier(qualifier, names.context, ctxField.Type)
+			}
+		}
+		if spec.path == "time" && names.time != "" && qualifier != names.time {
+			renameQualifier(qualifier, names.time, signature(fdecl)...)
+		}
+	}
+
+	if names.source != "" {
+		qualifyLocal(fdecl, names.source)
+	}
+
+	callExpr := &ast.CallExpr{Fun: t.callee(name, names.source)}
+	forwardArgs(callExpr, fdecl.Type.Params.List)
+	callExpr.Args = append(callExpr.Args, nil)
+	copy(callExpr.Args[ctxArg+1:], callExpr.Args[ctxArg:])
+	callExpr.Args[ctxArg] = ctxExpr
+	if t.argOrder != nil {
+		if opts.Passthrough {
+			return nil, fmt.Errorf("%s: //nocontext:argorder cannot be used with -passthrough", name)
+		}
+		fdecl.Type.Params.List = reorderParams(fdecl.Type.Params.List, t.argOrder)
+		// The comments would be misplaced among the reordered parameters.
+		t.comments = nil
+	}
+	if opts.Passthrough {
+		// The context parameter is kept in the signature as _, since the wrapped function is passed ctxExpr instead.
+		if len(ctxField.Names) == 0 {
+			ctxField.Names = []*ast.Ident{ast.NewIdent("_")}
+		} else {
+			ctxField.Names = append([]*ast.Ident{ast.NewIdent("_")}, ctxField.Names[1:]...)
+		}
+		fdecl.Type.Params.List = allParams
+		// The printer places the comma after the context parameter before the comments preceding the next one,
+		// which would then read as the comments of the context parameter. They are dropped instead.
+		comments := t.comments[:0]
+		for _, c := range t.comments {
+			if c.Pos() < ctxEnd || nextPos <= c.Pos() {
+				comments = append(comments, c)
+			}
+		}
+		t.comments = comments
+	}
+	if opts.MethodsAsFuncs && fdecl.Recv != nil {
+		recv := fdecl.Recv.List[0]
+		fdecl.Recv = nil
+		fdecl.Type.Params.List = append([]*ast.Field{{Names: recv.Names, Type: recv.Type}}, fdecl.Type.Params.List...)
+	}
+
+	var body ast.Expr = callExpr
+	if opts.WrapExpr != "" {
+		expr, err := wrapCall(opts.WrapExpr, fdecl.Name.Name, callExpr, ctxArg, names)
+		if err != nil {
+			return nil, err
+		}
+		body = expr
+	}
+
+	if opts.DeprecateStmt != "" {
+		deprecate, err := deprecateStmts(opts.DeprecateStmt, fdecl.Name.Name, callExpr.Fun, names)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(deprecate, stmts...)
+	}
+
+	fdecl.Doc = nil
+	if opts.Deprecated {
+		fdecl.Doc = &ast.CommentGroup{List: []*ast.Comment{{Text: "// Deprecated: Use " + name + " instead."}}}
+	}
+	if opts.ExplicitErr && returnsError(fdecl) {
+		fdecl.Body = t.explicitErrBody(fdecl.Type, body)
+	} else {
+		fdecl.Body = wrapperBody(fdecl.Type, body)
+	}
+	fdecl.Body.List = append(stmts, fdecl.Body.List...)
+	return fdecl, nil
+}
+
+// reverseDecl converts the context-less function of t into a WithContext variant ignoring its context.
+func reverseDecl(t *target, names stdNames, opts Options) *ast.FuncDecl {
+	fdecl := t.decl
+	t.qualifyDotContext(names.context)
+	name := fdecl.Name.Name
+	fdecl.Name.Name = t.wrapperName(opts)
+
+	t.nameRecv()
+	t.nameParams(fdecl.Type.Params.List)
+	if names.source != "" {
+		qualifyLocal(fdecl, names.source)
+	}
+	callExpr := &ast.CallExpr{Fun: t.callee(name, names.source)}
+	forwardArgs(callExpr, fdecl.Type.Params.List)
+
+	ctxParam := "ctx"
+	if t.declares(ctxParam, false) {
+		ctxParam = "_"
+	}
+	ctxField := &ast.Field{
+		Names: []*ast.Ident{ast.NewIdent(ctxParam)},
+		Type:  &ast.SelectorExpr{X: ast.NewIdent(names.context), Sel: ast.NewIdent("Context")},
+	}
+	fdecl.Type.Params.List = append([]*ast.Field{ctxField}, fdecl.Type.Params.List...)
+
+	fdecl.Doc = nil
+	fdecl.Body = wrapperBody(fdecl.Type, callExpr)
+	return fdecl
+}
+
+// stdName returns the qualifier of the standard package path in the generated file.
+// A parameter, result or receiver with the package name shadows the package in the
+// wrapper bodies, so the import is aliased for the whole file.
+func stdName(path string, targets []*target) string {
+	for _, t := range targets {
+		if t.declares(path, true) {
+			return "std" + path
+		}
+	}
+	return path
+}
+
+// docComment returns text as a line comment, e.g. a package doc comment.
+func docComment(text string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			b.WriteString("//\n")
+			continue
+		}
+		b.WriteString("// " + line + "\n")
+	}
+	return b.String()
+}
+
+// writeHeader writes the generated code header and the build constraint of opts, if any.
+func writeHeader(buf *bytes.Buffer, opts Options) error {
+	fmt.Fprintf(buf, "%s\n\n", header)
+	if opts.BuildTags != nil {
+		fmt.Fprintf(buf, "//go:build %s\n", opts.BuildTags)
+		if opts.LegacyTags {
+			lines, err := constraint.PlusBuildLines(opts.BuildTags)
+			if err != nil {
+				return fmt.Errorf("build tags: %w", err)
+			}
+			for _, line := range lines {
+				buf.WriteString(line + "\n")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return nil
+}
+
+// generate renders a Go source file containing the wrappers of targets.
+func generate(fset *token.FileSet, out *output, opts Options) ([]byte, error) {
+	targets := out.targets
+	// Reverse wrappers refer to context only in their signature, where it is never shadowed.
+	names := stdNames{context: contextPath}
+	if !opts.Reverse {
+		names.context = stdName(contextPath, targets)
+		if opts.Timeout > 0 {
+			names.time = stdName("time", targets)
+		}
+	}
+
+	if out.srcPath != "" {
+		names.source = sourceName(out.srcName, out.srcPath, targets)
+	}
+
+	sortTargets(fset, targets, opts)
+
+	ctxReason := "context.Background"
+	if opts.Reverse {
+		ctxReason = "context parameter of -reverse"
+	}
+	imports := map[string]importSpec{
+		names.context: {path: contextPath, explicit: names.context != contextPath, reason: ctxReason},
+	}
+	if names.time != "" {
+		imports[names.time] = importSpec{path: "time", explicit: names.time != "time", reason: "-timeout"}
+	}
+	if names.source != "" && len(targets) > 0 {
+		imports[names.source] = importSpec{path: out.srcPath, explicit: names.source != importName(out.srcPath), reason: "-out-dir"}
+	}
+	var decls []*ast.FuncDecl
+	for _, t := range targets {
+		var fdecl *ast.FuncDecl
+		if opts.Reverse {
+			fdecl = reverseDecl(t, names, opts)
+		} else {
+			var err error
+			fdecl, err = wrapperDecl(t, names, opts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, qualifier := range qualifiers(signature(fdecl)...) {
+			if _, ok := imports[qualifier]; ok {
+				continue
+			}
+			if spec, ok := t.imports[qualifier]; ok {
+				spec.reason = "signature of " + fdecl.Name.Name
+				imports[qualifier] = spec
+			}
+		}
+		ctxQualifiers, ctxReason := opts.ctxQualifiers, "-ctx-expr"
+		if t.ctxExpr != "" {
+			ctxQualifiers, ctxReason = t.ctxQualifiers, "//nocontext:ctx of "+fdecl.Name.Name
+		}
+		for _, qualifier := range ctxQualifiers {
+			if _, ok := imports[qualifier]; ok || qualifier == contextPath {
+				continue
+			}
+			if spec, ok := t.imports[qualifier]; ok {
+				spec.reason = ctxReason
+				imports[qualifier] = spec
+			}
+		}
+		for _, tmpl := range []struct {
+			flag       string
+			qualifiers []string
+		}{{"-wrap-expr", opts.wrapQualifiers}, {"-deprecate-expr", opts.deprecateQualifiers}} {
+			for _, qualifier := range tmpl.qualifiers {
+				if _, ok := imports[qualifier]; ok || qualifier == contextPath {
+					continue
+				}
+				if spec, ok := t.imports[qualifier]; ok {
+					spec.reason = tmpl.flag
+					imports[qualifier] = spec
+				} else {
+					log.Printf("%s: %s refers to %s, which is not imported by %s", out.displayPath(), tmpl.flag, qualifier, fset.Position(t.decl.Pos()).Filename)
+				}
+			}
+		}
+		decls = append(decls, fdecl)
+	}
+
+	var buf bytes.Buffer
+	if err := writeHeader(&buf, opts); err != nil {
+		return nil, err
+	}
+	// The standard packages are imported only if referred to, which they are not
+	// by a -ctx-expr without context or when no wrappers are generated.
+	used := make(map[string]bool)
+	for _, fdecl := range decls {
+		for _, qualifier := range qualifiers(fdecl) {
+			used[qualifier] = true
+		}
+	}
+	for _, name := range []string{names.context, names.time} {
+		if name != "" && !used[name] {
+			delete(imports, name)
+		}
+	}
+
+	if out.packageDoc {
+		buf.WriteString(docComment(opts.PackageDoc))
+	}
+	fmt.Fprintf(&buf, "package %s\n", out.pkgName)
+	if len(imports) > 0 {
+		buf.WriteString("\nimport (\n")
+	}
+	importNames := make([]string, 0, len(imports))
+	for name := range imports {
+		importNames = append(importNames, name)
+	}
+	sort.Strings(importNames)
+	for _, name := range importNames {
+		spec := imports[name]
+		if opts.Verbose {
+			alias := "no alias"
+			if spec.explicit {
+				alias = "alias " + name
+			}
+			log.Printf("%s: import %q (%s) for %s", out.displayPath(), spec.path, alias, spec.reason)
+		}
+		if spec.explicit {
+			fmt.Fprintf(&buf, "\t%s %q\n", name, spec.path)
+		} else {
+			fmt.Fprintf(&buf, "\t%q\n", spec.path)
+		}
+	}
+	if len(imports) > 0 {
+		buf.WriteString(")\n")
+	}
+	for i, fdecl := range decls {
+		// The wrappers of a group are adjacent, and the groups are separated by blank lines.
+		if i == 0 || !opts.GroupByReceiver || recvTypeName(fdecl) != recvTypeName(decls[i-1]) {
+			buf.WriteString("\n")
+		}
+		var node interface{} = fdecl
+		if comments := targets[i].comments; len(comments) > 0 {
+			// The printer interleaves the comments within the range of the node,
+			// which ends with the synthesized body otherwise having no position.
+			// It is placed right after the signature, so that no blank lines are inserted around it.
+			fdecl.Body.Lbrace, fdecl.Body.Rbrace = fdecl.Type.End(), fdecl.Type.End()
+			node = &printer.CommentedNode{Node: fdecl, Comments: comments}
+		}
+		if err := printer.Fprint(&buf, fset, node); err != nil {
+			return nil, fmt.Errorf("print %s: %w", fdecl.Name.Name, err)
+		}
+		buf.WriteString("\n")
+	}
+	if opts.Registry != "" {
+		writeRegistryInit(&buf, opts.Registry, registered(decls, out.displayPath(), opts.Verbose))
+	}
+	if opts.NoFormat {
+		return buf.Bytes(), nil
+	}
+	src, err := formatSource(out.path, buf.Bytes(), opts.FormatTool)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TrimImports {
+		if src, err = trimImports(src, out.displayPath(), opts.Verbose); err != nil {
+			return nil, err
+		}
+	}
+	// Literals copied from sources with CRLF line endings keep their carriage returns,
+	// while the printer emits LF. The outputs always use LF as gofmt does.
+	return bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n")), nil
+}
+
+// formatSource formats the generated file src to be written to path with tool,
+// which is goimports or gofmt. goimports also adds the missing imports and removes the unused ones.
+func formatSource(path string, src []byte, tool string) ([]byte, error) {
+	if tool == "goimports" {
+		return imports.Process(path, src, nil)
+	}
+	return format.Source(src)
+}
+
+// validateOutSuffix checks that suffix yields a regular Go source file name when inserted before ".go".
+func validateOutSuffix(suffix string) error {
+	if suffix == "" {
+		return fmt.Errorf("empty suffix would overwrite the source files")
+	}
+	if strings.ContainsAny(suffix, "/"+string(filepath.Separator)) {
+		return fmt.Errorf("%q contains a path separator", suffix)
+	}
+	if strings.HasSuffix(suffix, "_test") {
+		return fmt.Errorf("%q would produce test files", suffix)
+	}
+	return nil
+}
+
+// perFileOutput returns the output path of the wrappers generated from the source file at path,
+// which is next to it, or in outDir if not empty.
+func perFileOutput(path, suffix, outDir string) string {
+	out := strings.TrimSuffix(path, ".go") + suffix + ".go"
+	if outDir != "" {
+		out = filepath.Join(outDir, filepath.Base(out))
+	}
+	return out
+}
+
+// defaultSkipDirs are the directory names skipped by -r by default, which the go command ignores as well.
+// internal is not skipped, since its packages are part of the module.
+const defaultSkipDirs = "vendor,testdata,.*,_*"
+
+// collectFiles returns the Go source files in dir, walking its subdirectories if recursive.
+// The subdirectories whose names match a glob pattern of skipDirs are skipped,
+// as well as the files and directories matched by ignore. dir itself is never skipped.
+// It fails as soon as more than maxFiles files are found, unless maxFiles is 0.
+func collectFiles(dir string, recursive bool, skipDirs []string, ignore ignoreList, maxFiles int) ([]string, error) {
+	var fileNames []string
+	tooMany := fmt.Errorf("more than %d Go files in %s, narrow down -d or raise -max-files", maxFiles, dir)
+	err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			name := info.Name()
+			if !recursive || ignore.match(rel, true) {
+				return filepath.SkipDir
+			}
+			for _, pattern := range skipDirs {
+				if ok, _ := path.Match(pattern, name); ok {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !strings.HasSuffix(fpath, ".go") || ignore.match(rel, false) {
+			return nil
+		}
+		if maxFiles > 0 && len(fileNames) == maxFiles {
+			return tooMany
+		}
+		fileNames = append(fileNames, fpath)
+		return nil
+	})
+	if err == tooMany {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	return fileNames, nil
+}
+
+// outputExists reports whether the output file at path exists, which is never the case for the standard output.
+func outputExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// uniqueFiles removes the paths of fileNames referring to the same file as an earlier one by absolute path,
+// so that no file is wrapped twice however it entered the inputs.
+func uniqueFiles(fileNames []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, fpath := range fileNames {
+		abs, err := filepath.Abs(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("resolve source path: %w", err)
+		}
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+		unique = append(unique, fpath)
+	}
+	return unique, nil
+}
+
+// excludeOutputs removes the paths which are planned to be written from fileNames,
+// so that the outputs of a prior run are never treated as sources even if they do not exist yet.
+// The planned paths are returned as well.
+func excludeOutputs(fileNames []string, outputName string, perFile bool, outSuffix, outDir string) ([]string, map[string]bool, error) {
+	planned := make(map[string]bool)
+	if outputName != "" {
+		abs, err := filepath.Abs(outputName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolve output path: %w", err)
+		}
+		planned[abs] = true
+	}
+	absNames := make([]string, len(fileNames))
+	for i, fpath := range fileNames {
+		abs, err := filepath.Abs(fpath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("resolve source path: %w", err)
+		}
+		absNames[i] = abs
+		if perFile {
+			planned[perFileOutput(abs, outSuffix, outDir)] = true
+		}
+	}
+	var sources []string
+	for i, fpath := range fileNames {
+		if planned[absNames[i]] {
+			continue
+		}
+		sources = append(sources, fpath)
+	}
+	return sources, planned, nil
+}
+
+type output struct {
+	path string
+	// dir is the absolute directory of the package which the wrappers belong to,
+	// so that the packages are told apart however their paths are spelled.
+	dir string
+	// displayDir is the directory of the sources as given on the command line, for the reports.
+	displayDir string
+	pkgName    string
+	targets    []*target
+	src        []byte
+	// existing is the content of the output written by a prior run, which is kept by -only-missing.
+	existing []byte
+	// packageDoc is set on the output carrying Options.PackageDoc in its package.
+	packageDoc bool
+	// srcPath and srcName are the import path and the name of the source package
+	// if the wrappers are generated into another package by -out-dir.
+	srcPath, srcName string
+}
+
+// displayPath returns the path of out for messages.
+func (out *output) displayPath() string {
+	if out.path == "" {
+		return "stdout"
+	}
+	return out.path
+}
+
+func run() error {
+	fileName := flag.String("f", os.Getenv("GOFILE"), "target file (default $GOFILE)")
+	dirName := flag.String("d", "", "target directory")
+	recursive := flag.Bool("r", false, "walk the subdirectories of -d")
+	verifySuffix := flag.Bool("verify-suffix-consistency", false, "report the functions violating the naming convention of -suffix instead of generating")
+	replaceBackground := flag.String("replace-background", "", "rewrite context.Background() to context.TODO() in the generated files with todo, or back with background, instead of generating")
+	strict := flag.Bool("strict", false, "fail on the functions of files not importing context instead of warning")
+	maxFiles := flag.Int("max-files", 10000, "abort if -d has more Go files than this, 0 for no limit")
+	skipDirsFlag := flag.String("skip-dirs", defaultSkipDirs, "comma-separated glob patterns of the directory names skipped by -r")
+	outputName := flag.String("o", "", "output filename")
+	outDir := flag.String("out-dir", "", "write the outputs into the package in the directory instead of the source package")
+	module := flag.String("module", "", "module path of the sources for -out-dir")
+	relativeTo := flag.String("relative-to", "", "module root directory of the sources for -out-dir")
+	perFile := flag.Bool("per-file", false, "write the wrappers of each file next to it")
+	outSuffix := flag.String("out-suffix", "_nocontext", "inserted before .go in the output filenames of -per-file")
+	suffix := flag.String("suffix", "WithContext", "name suffix of the functions taking a context")
+	reverse := flag.Bool("reverse", false, "generate WithContext variants of functions without context")
+	sortBy := flag.String("sort", "source", "order of the wrappers: source or name")
+	list := flag.Bool("list-functions", false, "print the functions to be wrapped instead of generating")
+	ctxExpr := flag.String("ctx-expr", "context.Background()", "context expression passed by the wrappers")
+	timeout := flag.Duration("timeout", 0, "pass a context with the timeout instead of context.Background()")
+	outTags := flag.String("out-tags", "", "build constraint expression placed on the generated files")
+	legacyTags := flag.Bool("legacy-tags", false, "also emit // +build lines for -out-tags")
+	deprecateExpr := flag.String("deprecate-expr", "", "template of the statements run first by the wrappers, e.g. to record a deprecation (%n name, %f wrapped function)")
+	deprecated := flag.Bool("deprecated", false, "mark the wrappers as deprecated in favor of the wrapped functions")
+	wrapExpr := flag.String("wrap-expr", "", "template of the expression evaluated by the wrappers (%n name, %f wrapped function, %c context, %a arguments)")
+	ctxImportGroup := flag.String("context-import-group", "std", "group of the context import added to the existing outputs: std or separate")
+	onlyMissing := flag.Bool("only-missing", false, "keep the existing outputs and append only the missing wrappers")
+	inplace := flag.Bool("inplace", false, "append the missing wrappers to the source files themselves")
+	keepFormat := flag.Bool("indent-with-existing", false, "keep the formatting of the files merged by -inplace or -only-missing, indenting the wrappers like them")
+	packageDoc := flag.String("package-doc", "", "package doc comment placed on the first generated file of each package")
+	packageDocFrom := flag.String("package-doc-from", "", "file containing the text of -package-doc")
+	genTests := flag.Bool("gen-tests", false, "also write a _test.go file next to each output referring to the wrappers")
+	ctxPointer := flag.Bool("ctx-pointer", false, "wrap the functions taking a *context.Context by passing the address of a context variable")
+	passthrough := flag.Bool("passthrough", false, "keep the context parameter in the wrappers, ignoring it, as a temporary migration aid")
+	reportPath := flag.String("report-file", "", "write the summary of the run to the file, as JSON if it ends with .json")
+	changed := flag.Bool("changed", false, "process only the files staged in git, or changed since -changed-base")
+	changedBase := flag.String("changed-base", "", "git ref whose merge base with HEAD the files of -changed are compared with, e.g. origin/main")
+	explicitErr := flag.Bool("explicit-err", false, "return the errors of the wrapped functions from if statements")
+	skipCgo := flag.Bool("skip-cgo", false, "skip the files importing C with a warning")
+	recvCtx := flag.String("recv-ctx", "", "method of the receivers returning the context passed by the method wrappers instead of the context expression")
+	registry := flag.String("registry", "", "package-level map variable which an init function registers the function wrappers into by name")
+	manifestPath := flag.String("manifest", "", "write the wrappers generated by package as JSON to the file, or - for the standard output")
+	statsJSON := flag.String("stats-json", "", "write the migration coverage metrics as JSON to the file, or - for the standard output")
+	keepComments := flag.Bool("param-comments", false, "keep the comments in the parameter lists of the wrapped functions")
+	jobs := flag.Int("j", 1, "number of outputs generated in parallel")
+	noFormat := flag.Bool("noformat", false, "write the printer output without gofmt, for debugging")
+	formatTool := flag.String("format-tool", "gofmt", "formatter of the generated files: gofmt or goimports, which also fixes their imports")
+	visibility := flag.String("wrapper-visibility", "inherit", "case of the initial of the wrapper names: inherit, exported or unexported")
+	groupByRecv := flag.Bool("group-by-receiver", false, "group the wrappers by receiver type, functions first")
+	requireError := flag.Bool("require-error", false, "wrap only the functions returning an error as the last result")
+	trimImports := flag.Bool("trim-imports", false, "remove the imports unused by the generated code")
+	methodsAsFuncs := flag.Bool("methods-as-funcs", false, "generate functions taking the receiver as the first parameter for methods, named Type+Method")
+	promote := flag.String("promote", "", "comma-separated Type.Field to wrap the WithContext methods of the interface Field as methods of Type")
+	typeCheck := flag.Bool("typecheck", false, "type-check the generated code with the package before writing it")
+	verbose := flag.Bool("v", false, "log the imports added to each output and why")
+	include := flag.String("include", "", "wrap only the functions whose names match the regexp")
+	exclude := flag.String("exclude", "", "do not wrap the functions whose names match the regexp")
+	funcs := flag.String("funcs", "", "comma-separated names of the functions to wrap, overriding -include and -exclude")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if *fileName == "" && *dirName == "" {
+		flag.Usage()
+		return fmt.Errorf("require -f or -d")
+	}
+	if *fileName != "" && *dirName != "" {
+		flag.Usage()
+		return fmt.Errorf("either -f or -d, not both")
+	}
+	if *perFile && *outputName != "" {
+		flag.Usage()
+		return fmt.Errorf("either -o or -per-file, not both")
+	}
+	if *replaceBackground != "" && *replaceBackground != "todo" && *replaceBackground != "background" {
+		flag.Usage()
+		return fmt.Errorf("-replace-background must be todo or background")
+	}
+	if *maxFiles < 0 {
+		flag.Usage()
+		return fmt.Errorf("-max-files must not be negative")
+	}
+	if *inplace {
+		if *outputName != "" || *perFile || *outDir != "" {
+			flag.Usage()
+			return fmt.Errorf("-inplace cannot be used with -o, -per-file or -out-dir")
+		}
+		if *genTests || *noFormat || *outTags != "" || *packageDoc != "" || *packageDocFrom != "" {
+			flag.Usage()
+			return fmt.Errorf("-inplace cannot be used with -gen-tests, -noformat, -out-tags or -package-doc, which apply to generated files")
+		}
+	}
+	if *keepFormat && !*inplace && !*onlyMissing {
+		flag.Usage()
+		return fmt.Errorf("-indent-with-existing requires -inplace or -only-missing")
+	}
+	if *recursive && *dirName == "" {
+		flag.Usage()
+		return fmt.Errorf("-r requires -d")
+	}
+	if *recursive && !*perFile && !*inplace && !*list {
+		flag.Usage()
+		return fmt.Errorf("-r requires -per-file or -inplace, since the packages cannot share an output")
+	}
+	var outPkgName, absOutDir string
+	if *outDir != "" {
+		if *module == "" || *relativeTo == "" {
+			flag.Usage()
+			return fmt.Errorf("-out-dir requires -module and -relative-to to compute the import path of the sources")
+		}
+		if *recursive {
+			flag.Usage()
+			return fmt.Errorf("-out-dir cannot be used with -r, since the packages cannot share the directory")
+		}
+		if *promote != "" {
+			flag.Usage()
+			return fmt.Errorf("-promote cannot be used with -out-dir, since it generates methods")
+		}
+		if err := validateModulePath(*module); err != nil {
+			return fmt.Errorf("invalid -module: %w", err)
+		}
+		if err := checkDir(*relativeTo); err != nil {
+			return fmt.Errorf("invalid -relative-to: %w", err)
+		}
+		if err := checkDir(*outDir); err != nil {
+			return fmt.Errorf("invalid -out-dir: %w", err)
+		}
+		name, err := outPackageName(*outDir)
+		if err != nil {
+			return fmt.Errorf("invalid -out-dir: %w", err)
+		}
+		outPkgName = name
+		if absOutDir, err = filepath.Abs(*outDir); err != nil {
+			return fmt.Errorf("invalid -out-dir: %w", err)
+		}
+		if *outputName != "" {
+			*outputName = filepath.Join(*outDir, *outputName)
+		}
+	} else if *module != "" || *relativeTo != "" {
+		flag.Usage()
+		return fmt.Errorf("-module and -relative-to require -out-dir")
+	}
+	if *statsJSON == "-" && (*list || *outputName == "" && !*perFile && !*inplace) {
+		flag.Usage()
+		return fmt.Errorf("-stats-json - cannot be used when the wrappers are written to the standard output")
+	}
+	if *manifestPath == "-" && (*statsJSON == "-" || *outputName == "" && !*perFile && !*inplace) {
+		flag.Usage()
+		return fmt.Errorf("-manifest - cannot be used when the wrappers or -stats-json are written to the standard output")
+	}
+	if *genTests && *outputName == "" && !*perFile {
+		flag.Usage()
+		return fmt.Errorf("-gen-tests requires -o or -per-file")
+	}
+	if *noFormat {
+		if *trimImports || *onlyMissing {
+			flag.Usage()
+			return fmt.Errorf("-noformat cannot be used with -trim-imports or -only-missing, which format the outputs")
+		}
+		log.Printf("-noformat: the outputs are written as printed and may not be gofmt-clean")
+	}
+	if *jobs < 1 {
+		flag.Usage()
+		return fmt.Errorf("-j must be positive")
+	}
+	if *formatTool != "gofmt" && *formatTool != "goimports" {
+		flag.Usage()
+		return fmt.Errorf("-format-tool must be gofmt or goimports")
+	}
+	if *formatTool != "gofmt" && (*noFormat || *inplace) {
+		flag.Usage()
+		return fmt.Errorf("-format-tool goimports cannot be used with -noformat, which skips formatting, or -inplace, which formats the edited sources with gofmt")
+	}
+	if *visibility != "inherit" && *visibility != "exported" && *visibility != "unexported" {
+		flag.Usage()
+		return fmt.Errorf("-wrapper-visibility must be inherit, exported or unexported")
+	}
+	if *ctxImportGroup != "std" && *ctxImportGroup != "separate" {
+		flag.Usage()
+		return fmt.Errorf("-context-import-group must be std or separate")
+	}
+	if *methodsAsFuncs && *reverse {
+		flag.Usage()
+		return fmt.Errorf("-methods-as-funcs cannot be used with -reverse")
+	}
+	if *passthrough && *reverse {
+		flag.Usage()
+		return fmt.Errorf("-passthrough cannot be used with -reverse")
+	}
+	if !token.IsIdentifier("X" + *suffix) {
+		flag.Usage()
+		return fmt.Errorf("-suffix %q is not a valid identifier suffix", *suffix)
+	}
+	opts := Options{Suffix: *suffix, Reverse: *reverse, Sort: *sortBy, Timeout: *timeout, Verbose: *verbose, MethodsAsFuncs: *methodsAsFuncs, TrimImports: *trimImports, CtxPointer: *ctxPointer, RequireError: *requireError, GroupByReceiver: *groupByRecv, Visibility: *visibility, ParamComments: *keepComments, Passthrough: *passthrough, NoFormat: *noFormat, FormatTool: *formatTool, Registry: *registry, ExplicitErr: *explicitErr}
+	if *recvCtx != "" && !token.IsIdentifier(*recvCtx) {
+		flag.Usage()
+		return fmt.Errorf("-recv-ctx %q is not an identifier", *recvCtx)
+	}
+	if *changedBase != "" && !*changed {
+		flag.Usage()
+		return fmt.Errorf("-changed-base requires -changed")
+	}
+	if *changed && !*perFile && !*inplace && !*list && !*verifySuffix && *replaceBackground == "" {
+		flag.Usage()
+		return fmt.Errorf("-changed requires -per-file, -inplace or a mode not generating, since a shared output would lose the wrappers of the unchanged files")
+	}
+	if *explicitErr && *reverse {
+		flag.Usage()
+		return fmt.Errorf("-explicit-err cannot be used with -reverse")
+	}
+	if *recvCtx != "" && *reverse {
+		flag.Usage()
+		return fmt.Errorf("-recv-ctx cannot be used with -reverse")
+	}
+	if *registry != "" && !token.IsIdentifier(*registry) {
+		flag.Usage()
+		return fmt.Errorf("-registry %q is not an identifier", *registry)
+	}
+	if *packageDoc != "" && *packageDocFrom != "" {
+		flag.Usage()
+		return fmt.Errorf("either -package-doc or -package-doc-from, not both")
+	}
+	opts.PackageDoc = *packageDoc
+	if *packageDocFrom != "" {
+		doc, err := ioutil.ReadFile(*packageDocFrom)
+		if err != nil {
+			return fmt.Errorf("read package doc: %w", err)
+		}
+		opts.PackageDoc = string(doc)
+	}
+	if *include != "" {
+		re, err := regexp.Compile(*include)
+		if err != nil {
+			return fmt.Errorf("invalid -include: %w", err)
+		}
+		opts.Include = re
+	}
+	if *exclude != "" {
+		re, err := regexp.Compile(*exclude)
+		if err != nil {
+			return fmt.Errorf("invalid -exclude: %w", err)
+		}
+		opts.Exclude = re
+	}
+	if *funcs != "" {
+		opts.Funcs = make(map[string]bool)
+		for _, name := range strings.Split(*funcs, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				opts.Funcs[name] = true
+			}
+		}
+	}
+	var skipDirs []string
+	for _, pattern := range strings.Split(*skipDirsFlag, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid -skip-dirs %q: %w", pattern, err)
+		}
+		skipDirs = append(skipDirs, pattern)
+	}
+	if *outTags != "" {
+		expr, err := constraint.Parse("//go:build " + *outTags)
+		if err != nil {
+			return fmt.Errorf("invalid -out-tags: %w", err)
+		}
+		opts.BuildTags = expr
+		opts.LegacyTags = *legacyTags
+	} else if *legacyTags {
+		flag.Usage()
+		return fmt.Errorf("-legacy-tags requires -out-tags")
+	}
+	ctxQualifiers, err := parseCtxExpr(*ctxExpr)
 	if err != nil {
-		return nil, fmt.Errorf("open file: %w", err)
+		return fmt.Errorf("invalid -ctx-expr: %w", err)
 	}
-	defer f.Close()
-	return parser.ParseFile(token.NewFileSet(), path, f, 0)
-}
-
-func run() error {
-	fileName := flag.String("f", os.Getenv("GOFILE"), "target file (default $GOFILE)")
-	dirName := flag.String("d", "", "target directory")
-	outputName := flag.String("o", "", "output filename")
-
-	flag.Parse()
-
-	if *fileName == "" && *dirName == "" {
+	opts.CtxExpr = *ctxExpr
+	opts.ctxQualifiers = ctxQualifiers
+	promoteSpecs, err := parsePromoteSpecs(*promote)
+	if err != nil {
+		return fmt.Errorf("invalid -promote: %w", err)
+	}
+	if len(promoteSpecs) > 0 && *reverse {
 		flag.Usage()
-		return fmt.Errorf("require -f or -d")
+		return fmt.Errorf("-promote cannot be used with -reverse")
 	}
-	if *fileName != "" && *dirName != "" {
+	if *wrapExpr != "" {
+		if *reverse {
+			flag.Usage()
+			return fmt.Errorf("-wrap-expr cannot be used with -reverse")
+		}
+		qualifiers, err := parseWrapExpr(*wrapExpr)
+		if err != nil {
+			return fmt.Errorf("invalid -wrap-expr: %w", err)
+		}
+		opts.WrapExpr = *wrapExpr
+		opts.wrapQualifiers = qualifiers
+	}
+	if (*deprecateExpr != "" || *deprecated) && *reverse {
 		flag.Usage()
-		return fmt.Errorf("either -f or -d, not both")
+		return fmt.Errorf("-deprecate-expr and -deprecated cannot be used with -reverse")
+	}
+	if *deprecateExpr != "" {
+		qualifiers, err := parseDeprecateStmt(*deprecateExpr)
+		if err != nil {
+			return fmt.Errorf("invalid -deprecate-expr: %w", err)
+		}
+		opts.DeprecateStmt = *deprecateExpr
+		opts.deprecateQualifiers = qualifiers
+	}
+	opts.Deprecated = *deprecated
+	if *sortBy != "source" && *sortBy != "name" {
+		flag.Usage()
+		return fmt.Errorf("invalid -sort: %q", *sortBy)
+	}
+	if *perFile {
+		if err := validateOutSuffix(*outSuffix); err != nil {
+			return fmt.Errorf("invalid -out-suffix: %w", err)
+		}
 	}
 
 	var fileNames []string
 	switch {
 	case *fileName != "":
+		if info, err := os.Stat(*fileName); err == nil && info.IsDir() {
+			return fmt.Errorf("-f %s is a directory, use -d for directories", *fileName)
+		}
 		fileNames = append(fileNames, *fileName)
 	case *dirName != "":
-		infoList, err := ioutil.ReadDir(*dirName)
+		if info, err := os.Stat(*dirName); err == nil && !info.IsDir() {
+			return fmt.Errorf("-d %s is not a directory, use -f for files", *dirName)
+		}
+		ignore, err := readIgnoreFile(filepath.Join(*dirName, ignoreFileName))
 		if err != nil {
-			return fmt.Errorf("read dir: %w", err)
+			return err
 		}
-		for _, info := range infoList {
-			name := info.Name()
-			if !strings.HasSuffix(name, ".go") {
-				continue
+		fileNames, err = collectFiles(*dirName, *recursive, skipDirs, ignore, *maxFiles)
+		if err != nil {
+			return err
+		}
+	}
+	fileNames, err = uniqueFiles(fileNames)
+	if err != nil {
+		return err
+	}
+	if *changed && len(fileNames) > 0 {
+		gitDir := *dirName
+		if gitDir == "" {
+			gitDir = filepath.Dir(fileNames[0])
+		}
+		files, err := changedFiles(gitDir, *changedBase)
+		if err != nil {
+			// Outside a git repository, everything is processed as if -changed were not given.
+			log.Printf("-changed: process all the files: %v", err)
+		} else {
+			fileNames = filterChanged(fileNames, files)
+			if len(fileNames) == 0 {
+				if *verbose {
+					log.Printf("-changed: no changed files")
+				}
+				return nil
 			}
-			fileNames = append(fileNames, filepath.Join(*dirName, name))
 		}
 	}
 
-	var w io.Writer = os.Stdout
-	if *outputName != "" {
-		f, err := os.Create(*outputName)
-		if err != nil {
-			return fmt.Errorf("create file: %w", err)
+	if *replaceBackground != "" {
+		from, to := "Background", "TODO"
+		if *replaceBackground == "background" {
+			from, to = to, from
 		}
-		defer f.Close()
-		w = f
+		return replaceContextCalls(fileNames, from, to, *verbose)
+	}
+
+	fileNames, planned, err := excludeOutputs(fileNames, *outputName, *perFile, *outSuffix, absOutDir)
+	if err != nil {
+		return err
 	}
 
+	fset := token.NewFileSet()
+	coverage := newStats()
+	var violations []string
+	var outputs []*output
+	bySource := make(map[string]*output)
+	indexes := make(map[string]*declIndex)
+	// The sources are indexed as they are parsed, so that their syntax trees are not kept, and the outputs never.
+	// The other files of the packages, e.g. the siblings of -f, the files of the ignore file or the sources
+	// parsed up to their package clause, are indexed after the loop without them.
+	indexed := make(map[string]bool)
+	for path := range planned {
+		indexed[path] = true
+	}
+	var sourceDirs []string
+	sourcePkgs := make(map[string]string)
+	skippedCgo := 0
+	// Unless all the functions are inspected, the files without the suffix are merely scanned for it.
+	prescan := opts.Suffix
+	if *reverse || *statsJSON != "" || *verifySuffix {
+		prescan = ""
+	}
 	for _, fpath := range fileNames {
-		if fpath == *outputName {
-			continue
+		abs, err := filepath.Abs(fpath)
+		if err != nil {
+			return fmt.Errorf("resolve source path: %w", err)
 		}
-		f, err := parseFile(fpath)
+		f, src, err := parseFile(fset, fpath, opts.ParamComments, prescan)
 		if err != nil {
 			log.Print("failed to parse:", err)
+			indexed[abs] = true
+			continue
+		}
+		if isGenerated(src) {
+			// The outputs of a prior run are never wrapped again, wherever they were written,
+			// but the wrappers of this run must not collide with them unless they are overwritten.
+			if opts.Verbose {
+				log.Printf("%s: skip the file generated by nocontext", fpath)
+			}
+			continue
+		}
+		// The files skipped by -skip-cgo are still indexed by packageFiles.
+		if *skipCgo && importsC(f) {
+			log.Printf("%s: skip the file importing C", fpath)
+			skippedCgo++
+			continue
+		}
+		dir, displayDir := filepath.Dir(abs), filepath.Dir(fpath)
+		if f.Decls != nil {
+			indexed[abs] = true
+			if indexes[dir] == nil {
+				indexes[dir] = newDeclIndex()
+				sourceDirs = append(sourceDirs, dir)
+				sourcePkgs[dir] = f.Name.Name
+			}
+			indexes[dir].add(f)
+		}
+		var out *output
+		if *inplace {
+			// The source file is merged with its wrappers as an existing output, which keeps all of it.
+			out = &output{path: fpath, dir: dir, displayDir: displayDir, pkgName: f.Name.Name, existing: src}
+			outputs = append(outputs, out)
+		} else if *perFile {
+			out = &output{path: perFileOutput(fpath, *outSuffix, *outDir), dir: dir, displayDir: displayDir, pkgName: f.Name.Name}
+			outputs = append(outputs, out)
+		} else if len(outputs) == 0 {
+			out = &output{path: *outputName, dir: dir, displayDir: displayDir, pkgName: f.Name.Name}
+			outputs = append(outputs, out)
+		} else {
+			out = outputs[0]
+		}
+		if *outDir != "" && out.srcPath == "" {
+			if out.srcPath, err = importPath(*module, *relativeTo, dir); err != nil {
+				return fmt.Errorf("-relative-to: %w", err)
+			}
+			out.srcName = f.Name.Name
+			out.dir, out.pkgName = absOutDir, outPkgName
+			if indexes[out.dir] == nil {
+				// The wrappers must not collide with the declarations of the output package either.
+				files, err := packageFiles(fset, out.dir, out.pkgName, planned)
+				if err != nil {
+					return fmt.Errorf("-out-dir: %w", err)
+				}
+				indexes[out.dir] = newDeclIndex()
+				for _, f := range files {
+					indexes[out.dir].add(f)
+				}
+			}
+		}
+		bySource[abs] = out
+		imports := fileImports(f)
+		importsContext := false
+		for _, spec := range f.Imports {
+			if path, err := strconv.Unquote(spec.Path.Value); err == nil && path == contextPath {
+				importsContext = true
+			}
+		}
+		fileOpts, err := fileConfig(fset, f, opts)
+		if err != nil {
+			return err
+		}
+		// The names declared by the cgo preamble are visible to the file only, unless the wrappers are appended to it.
+		cgo := importsC(f) && !*inplace
+		if *verifySuffix {
+			violations = append(violations, suffixViolations(fset, f, imports, fileOpts.Suffix)...)
 			continue
 		}
 		for _, decl := range f.Decls {
@@ -82,60 +1814,406 @@ func run() error {
 			if !ok {
 				continue
 			}
+			coverage.addFunc(displayDir, f.Name.Name, fdecl, imports, fileOpts.Suffix)
 			if !fdecl.Name.IsExported() {
 				continue
 			}
-			if !strings.HasSuffix(fdecl.Name.Name, "WithContext") {
+			if *reverse {
+				if strings.HasSuffix(fdecl.Name.Name, fileOpts.Suffix) || hasContextParam(fdecl, imports) {
+					continue
+				}
+			} else if !strings.HasSuffix(fdecl.Name.Name, fileOpts.Suffix) || fdecl.Name.Name == fileOpts.Suffix {
 				continue
 			}
-
-			name := fdecl.Name.Name
-			fdecl.Name.Name = strings.TrimSuffix(fdecl.Name.Name, "WithContext")
-			fdecl.Type.Params.List = fdecl.Type.Params.List[1:]
-
-			var fun ast.Expr
-			if fdecl.Recv != nil {
-				fun = &ast.SelectorExpr{X: ast.NewIdent(fdecl.Recv.List[0].Names[0].Name), Sel: ast.NewIdent(name)}
-			} else {
-				fun = ast.NewIdent(name)
+			if !opts.selects(fdecl.Name.Name) || opts.RequireError && !returnsError(fdecl) {
+				continue
+			}
+			if opts.MethodsAsFuncs && hasTypeParams(fdecl) {
+				log.Printf("%s: skip %s: -methods-as-funcs does not support generic receivers", fset.Position(fdecl.Pos()), fdecl.Name.Name)
+				continue
+			}
+			if *outDir != "" {
+				if recv := recvTypeName(fdecl); recv != "" {
+					// The methods of a type can only be declared in its package, and -methods-as-funcs
+					// would have to qualify the receiver, which is not supported either.
+					log.Printf("%s: skip %s: -out-dir cannot declare methods of %s.%s in package %s", fset.Position(fdecl.Pos()), qualifiedName(recv, fdecl.Name.Name), out.srcName, recv, out.pkgName)
+					continue
+				}
+				if refs := unexportedRefs(fdecl); len(refs) > 0 {
+					log.Printf("%s: skip %s: -out-dir cannot refer to unexported %s", fset.Position(fdecl.Pos()), fdecl.Name.Name, strings.Join(refs, ", "))
+					continue
+				}
+			}
+			if refs := preambleRefs(fdecl); cgo && len(refs) > 0 {
+				log.Printf("%s: skip %s: the output cannot refer to %s of the cgo preamble", fset.Position(fdecl.Pos()), fdecl.Name.Name, strings.Join(refs, ", "))
+				continue
+			}
+			ctxPointer := false
+			if !*reverse {
+				var reason string
+				if ctxPointer, reason = contextParam(fdecl, imports, opts.CtxPointer); reason != "" {
+					log.Printf("%s: skip %s: %s", fset.Position(fdecl.Pos()), fdecl.Name.Name, reason)
+					continue
+				}
+			}
+			if !*reverse && !importsContext {
+				// The first parameter is taken as the context, which is unlikely without the import, e.g. with a type alias.
+				msg := fmt.Sprintf("%s: %s: the file does not import context, so the first parameter may not be a context", fset.Position(fdecl.Pos()), fdecl.Name.Name)
+				if *strict {
+					return errors.New(msg)
+				}
+				log.Print(msg)
+			}
+			t := &target{decl: detach(fdecl), imports: imports, suffix: fileOpts.Suffix, ctxPointer: ctxPointer}
+			if fileOpts.CtxExpr != opts.CtxExpr {
+				t.ctxExpr, t.ctxQualifiers = fileOpts.CtxExpr, fileOpts.ctxQualifiers
+			}
+			if opts.ParamComments {
+				t.comments = paramComments(fset, f, src, t)
+			}
+			if !*reverse {
+				if err := t.readDirectives(fset); err != nil {
+					return err
+				}
+			}
+			out.targets = append(out.targets, t)
+		}
+	}
+	if *verifySuffix {
+		for _, v := range violations {
+			if _, err := fmt.Println(v); err != nil {
+				return fmt.Errorf("write violations: %w", err)
+			}
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("%d functions violate the naming convention", len(violations))
+		}
+		return nil
+	}
+	if len(outputs) == 0 {
+		if skippedCgo > 0 {
+			// The inputs were skipped as requested, e.g. by //go:generate in a file importing C.
+			return nil
+		}
+		return fmt.Errorf("no source files")
+	}
+	for _, dir := range sourceDirs {
+		// The wrappers must not collide with the declarations in any file of the package.
+		files, err := packageFiles(token.NewFileSet(), dir, sourcePkgs[dir], indexed)
+		if err != nil {
+			log.Printf("%s: the collisions with the other files of the package are not detected: %v", dir, err)
+		}
+		for _, f := range files {
+			indexes[dir].add(f)
+		}
+	}
+	if len(promoteSpecs) > 0 {
+		specs := promoteSpecs
+		found := make(map[promoteSpec]bool)
+		seen := make(map[string]bool)
+		for _, out := range outputs {
+			if seen[out.dir] {
+				continue
+			}
+			seen[out.dir] = true
+			pkgOut := out
+			outputFor := func(file string) *output {
+				if o, ok := bySource[file]; ok {
+					return o
+				}
+				return pkgOut
+			}
+			promoted, err := promoteTargets(out.dir, out.pkgName, specs, opts, planned, outputFor)
+			if err != nil {
+				return err
 			}
+			for _, spec := range promoted {
+				found[spec] = true
+			}
+		}
+		for _, spec := range specs {
+			if !found[spec] {
+				return fmt.Errorf("-promote: type %s is not found", spec.typeName)
+			}
+		}
+	}
+	if *recvCtx != "" {
+		useRecvCtx(outputs, indexes, *recvCtx)
+	}
+	if opts.Funcs != nil {
+		found := make(map[string]bool)
+		for _, t := range allTargets(outputs) {
+			found[t.decl.Name.Name] = true
+		}
+		var missing []string
+		for name := range opts.Funcs {
+			if !found[name] {
+				missing = append(missing, name)
+			}
+		}
+		sort.Strings(missing)
+		for _, name := range missing {
+			log.Printf("-funcs: %s is not found", name)
+		}
+	}
 
-			callExpr := &ast.CallExpr{
-				Fun: fun,
-				Args: []ast.Expr{
-					&ast.CallExpr{
-						Fun:  &ast.SelectorExpr{X: ast.NewIdent("context"), Sel: ast.NewIdent("Background")},
-						Args: []ast.Expr{},
-					},
-				},
+	if *list {
+		if err := listFunctions(os.Stdout, fset, allTargets(outputs), opts); err != nil {
+			return fmt.Errorf("write function list: %w", err)
+		}
+		if *statsJSON != "" {
+			// The functions listed are counted as the wrappers.
+			coverage.addWrappers(fset, outputs)
+			if err := coverage.write(*statsJSON); err != nil {
+				return fmt.Errorf("-stats-json: %w", err)
+			}
+		}
+		return nil
+	}
+	if *onlyMissing {
+		// The existing outputs are kept, and only the missing wrappers are appended to them.
+		for _, out := range outputs {
+			if out.path == "" {
+				continue
 			}
+			src, err := ioutil.ReadFile(out.path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("read existing output: %w", err)
+			}
+			f, err := parser.ParseFile(fset, out.path, src, parser.SkipObjectResolution)
+			if err != nil {
+				return fmt.Errorf("parse existing output: %w", err)
+			}
+			if indexes[out.dir] == nil {
+				indexes[out.dir] = newDeclIndex()
+			}
+			indexes[out.dir].add(f)
+			out.existing = src
+		}
+	}
+	// The wrappers already in the sources of -inplace are expected, as in the existing outputs of -only-missing.
+	skipCollisions(outputs, indexes, opts, *onlyMissing || *inplace)
+
+	if opts.Registry != "" {
+		if err := checkRegistry(outputs, indexes, opts); err != nil {
+			return fmt.Errorf("-registry: %w", err)
+		}
+	}
 
-			for _, param := range fdecl.Type.Params.List {
-				for _, name := range param.Names {
-					callExpr.Args = append(callExpr.Args, name)
+	var pending []*output
+	for _, out := range outputs {
+		if len(out.targets) == 0 && (*perFile || out.existing != nil || !outputExists(out.path)) {
+			// No file is created without wrappers, but the output of -o is rewritten to drop the stale ones of a prior run.
+			continue
+		}
+		pending = append(pending, out)
+	}
+	if opts.PackageDoc != "" {
+		// The doc is placed on the first output of each package by name, which is stable across runs.
+		first := make(map[string]*output)
+		for _, out := range pending {
+			if f, ok := first[out.dir]; !ok || out.path < f.path {
+				first[out.dir] = out
+			}
+		}
+		for _, out := range first {
+			out.packageDoc = true
+		}
+	}
+	var wrappers []*manifestPackage
+	if *manifestPath != "" {
+		wrappers = manifest(fset, pending, opts)
+	}
+	names := make(map[*output][]string)
+	if *reportPath != "" {
+		for _, out := range pending {
+			names[out] = wrapperNames(out, opts)
+		}
+	}
+	// The workers of -j only fill the sources of their outputs, which are written in order afterwards,
+	// so that the outputs do not depend on the number of workers.
+	genErrs := make([]error, len(pending))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *jobs)
+	for i, out := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, out *output) {
+			defer wg.Done()
+			genErrs[i] = generateOutput(fset, out, opts, *ctxImportGroup, *keepFormat)
+			<-sem
+		}(i, out)
+	}
+	wg.Wait()
+	var generated []*output
+	for i, out := range pending {
+		if genErrs[i] != nil {
+			return genErrs[i]
+		}
+		generated = append(generated, out)
+	}
+	if *typeCheck {
+		excluded := planned
+		if *inplace {
+			// The sources rewritten by -inplace are replaced by their outputs.
+			excluded = make(map[string]bool)
+			for path := range planned {
+				excluded[path] = true
+			}
+			for _, out := range generated {
+				if abs, err := filepath.Abs(out.path); err == nil {
+					excluded[abs] = true
 				}
 			}
-
-			if fdecl.Type.Results != nil {
-				fdecl.Body.List = []ast.Stmt{
-					&ast.ReturnStmt{
-						Results: []ast.Expr{callExpr},
-					},
+		}
+		if err := typecheck(generated, excluded); err != nil {
+			return err
+		}
+	}
+	if *genTests {
+		var tests []*output
+		for _, out := range generated {
+			test := &output{path: testOutput(out.path), dir: out.dir, displayDir: out.displayDir, pkgName: out.pkgName}
+			test.src, err = generateTest(out, opts)
+			if err != nil {
+				return fmt.Errorf("generate test: %w", err)
+			}
+			if out.existing != nil {
+				existing, err := ioutil.ReadFile(test.path)
+				if err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("read existing test: %w", err)
 				}
-			} else {
-				fdecl.Body.List = []ast.Stmt{
-					&ast.ExprStmt{
-						X: callExpr,
-					},
+				if err == nil {
+					if test.src, err = mergeGenerated(existing, test.src, *ctxImportGroup, *keepFormat); err != nil {
+						return fmt.Errorf("%s: %w", test.path, err)
+					}
 				}
 			}
-			printer.Fprint(w, token.NewFileSet(), fdecl)
-			fmt.Fprintln(w)
+			tests = append(tests, test)
+		}
+		generated = append(generated, tests...)
+	}
+	// A failure on one output does not prevent writing the others.
+	var errs []string
+	failed := make(map[*output]error)
+	for _, out := range generated {
+		if err := writeOutput(out.path, out.src); err != nil {
+			errs = append(errs, err.Error())
+			failed[out] = err
+		}
+	}
+	// The report is written even if some outputs failed, to tell which.
+	var reportErr error
+	if *reportPath != "" {
+		reportErr = newReport(os.Args[1:], generated, names, failed).write(*reportPath)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to write %d of %d outputs:\n%s", len(errs), len(generated), strings.Join(errs, "\n"))
+	}
+	if reportErr != nil {
+		return fmt.Errorf("-report-file: %w", reportErr)
+	}
+	if *manifestPath != "" {
+		if err := writeManifest(*manifestPath, wrappers); err != nil {
+			return fmt.Errorf("-manifest: %w", err)
+		}
+	}
+	if *statsJSON != "" {
+		coverage.addWrappers(fset, pending)
+		if err := coverage.write(*statsJSON); err != nil {
+			return fmt.Errorf("-stats-json: %w", err)
+		}
+	}
+	return nil
+}
+
+// generateOutput sets the source of out to the generated wrappers, merged into its existing content if any.
+// It is called concurrently for distinct outputs by the workers of -j.
+func generateOutput(fset *token.FileSet, out *output, opts Options, ctxGroup string, keepFormat bool) error {
+	src, err := generate(fset, out, opts)
+	if err != nil {
+		return fmt.Errorf("generate: %w", err)
+	}
+	if out.existing != nil {
+		if src, err = mergeGenerated(out.existing, src, ctxGroup, keepFormat); err != nil {
+			return fmt.Errorf("%s: %w", out.path, err)
+		}
+	}
+	out.src = src
+	return nil
+}
+
+// writeOutput writes src to the file at path, or to the standard output if path is empty.
+// The file is written to a temporary file in the same directory and renamed,
+// so that a failure never leaves a half-written file.
+func writeOutput(path string, src []byte) error {
+	if path == "" {
+		if _, err := os.Stdout.Write(src); err != nil {
+			return fmt.Errorf("write stdout: %w", err)
 		}
+		return nil
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	if _, err := tmp.Write(src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	// A full disk may be reported only when the data is flushed.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("rename %s: %w", path, err)
 	}
 	return nil
 }
 
+const usageText = `Usage: nocontext [flags] (-f file | -d dir)
+
+nocontext generates wrappers without context for context-aware functions.
+For each exported function FooWithContext(ctx context.Context, ...), it generates
+Foo(...), which calls FooWithContext with context.Background(). The suffix is set
+by -suffix, and the context passed by -ctx-expr or -timeout.
+
+Examples:
+	//go:generate nocontext -o nocontext.go
+		wrap the functions of the file running go generate into nocontext.go
+	nocontext -d ./service -per-file
+		write the wrappers of each file foo.go to foo_nocontext.go next to it
+	nocontext -d . -r -per-file -ctx-expr 'context.TODO()'
+		walk the subdirectories too, passing context.TODO()
+
+Flags:
+`
+
+// usage prints the description of the tool and its flags to the output of the flag package.
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), usageText)
+	flag.PrintDefaults()
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("nocontext: ")
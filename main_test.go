@@ -0,0 +1,1227 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, keyed by their slash-separated paths, into a temporary directory and returns it.
+func writeFiles(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readFile returns the content of the file at path.
+func readFile(t testing.TB, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// runNocontext runs the command with args in dir and returns what it logged.
+// The flags are parsed into a fresh flag set, so that it can be run repeatedly.
+func runNocontext(t testing.TB, dir string, args ...string) (string, error) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	commandLine, osArgs := flag.CommandLine, os.Args
+	defer func() { flag.CommandLine, os.Args = commandLine, osArgs }()
+	flag.CommandLine = flag.NewFlagSet("nocontext", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(ioutil.Discard)
+	os.Args = append([]string{"nocontext"}, args...)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	log.SetFlags(0)
+	log.SetPrefix("nocontext: ")
+	defer log.SetOutput(os.Stderr)
+	err = run()
+	return logs.String(), err
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		args  []string
+		// want are the contents of the files after the run by their paths.
+		want map[string]string
+		// missing are the paths of the files which the run must not create.
+		missing []string
+		// wantLog are the messages expected in the log.
+		wantLog []string
+	}{
+		{
+			name: "result named context",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext(ctx context.Context) (context string) { return "" }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	stdcontext "context"
+)
+
+func Do() (context string) { return DoWithContext(stdcontext.Background()) }
+`},
+		},
+		{
+			name: "context declared with another parameter",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext(ctx, other context.Context) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Do(other context.Context) error { return DoWithContext(context.Background(), other) }
+`},
+		},
+		{
+			name: "timeout without results",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func PingWithContext(ctx context.Context) {}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-timeout", "3s", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+	"time"
+)
+
+func Ping() {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	PingWithContext(ctx)
+}
+`},
+		},
+		{
+			name: "timeout with results",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func GetWithContext(ctx context.Context, id int) (string, error) { return "", nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-timeout", "3s", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+	"time"
+)
+
+func Get(id int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return GetWithContext(ctx, id)
+}
+`},
+		},
+		{
+			name: "blank parameter",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext(ctx context.Context, _ int, name string) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Do(_arg0 int, name string) error { return DoWithContext(context.Background(), _arg0, name) }
+`},
+		},
+		{
+			name: "CRLF line endings",
+			files: map[string]string{"a.go": strings.ReplaceAll(`package p
+
+import "context"
+
+func GetWithContext(ctx context.Context, s string) error {
+	return nil
+}
+`, "\n", "\r\n")},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Get(s string) error { return GetWithContext(context.Background(), s) }
+`},
+		},
+		{
+			name: "context not first",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func NewServiceWithContext(name string, ctx context.Context) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func NewService(name string) error { return NewServiceWithContext(name, context.Background()) }
+`},
+		},
+		{
+			name: "context and variadic only",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func LogWithContext(ctx context.Context, args ...any) {}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Log(args ...any) { LogWithContext(context.Background(), args...) }
+`},
+		},
+		{
+			name: "nameless generic receiver",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+type Cache[K comparable, V any] struct{}
+
+func (*Cache[K, V]) GetWithContext(ctx context.Context, k K) V {
+	var v V
+	return v
+}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func (c *Cache[K, V]) Get(k K) V { return c.GetWithContext(context.Background(), k) }
+`},
+		},
+		{
+			name: "comments around the context parameter",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext(ctx context.Context /* dropped */, /* the id */ id int, name string /* the name */) {}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-param-comments"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Do( /* the id */ id int, name string /* the name */) {
+	DoWithContext(context.Background(), id, name)
+}
+`},
+		},
+		{
+			name: "callback first",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func RunWithContext(fn func(ctx context.Context) error) error { return nil }
+
+func GoWithContext(ctx context.Context, fn func(ctx context.Context) error) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Go(fn func(ctx context.Context) error) error { return GoWithContext(context.Background(), fn) }
+`},
+			wantLog: []string{"skip RunWithContext: the first parameter is not a context.Context but refers to it"},
+		},
+		{
+			name: "anonymous struct with tags",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext(ctx context.Context, req struct {
+	ID   int    ` + "`json:\"id\"`" + `
+	Name string ` + "`json:\"name,omitempty\"`" + `
+}) error {
+	return nil
+}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Do(req struct {
+	ID   int    ` + "`json:\"id\"`" + `
+	Name string ` + "`json:\"name,omitempty\"`" + `
+}) error {
+	return DoWithContext(context.Background(), req)
+}
+`},
+		},
+		{
+			name: "suffix trimmed once",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func AWithContext(ctx context.Context) {}
+
+func WithContextWithContext(ctx context.Context) {}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func A() { AWithContext(context.Background()) }
+
+func WithContext() { WithContextWithContext(context.Background()) }
+`},
+		},
+		{
+			name: "explicit errors under timeout",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+type T struct{}
+
+func GetWithContext(ctx context.Context, id int) (T, error) { return T{}, nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-explicit-err", "-timeout", "1500ms", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+	"time"
+)
+
+func Get(id int) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	r0, err := GetWithContext(ctx, id)
+	if err != nil {
+		return r0, err
+	}
+	return r0, nil
+}
+`},
+		},
+		{
+			name: "functional options",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+type Option func(*Thing)
+
+type Thing struct{}
+
+func NewWithContext(ctx context.Context, opts ...Option) *Thing { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func New(opts ...Option) *Thing { return NewWithContext(context.Background(), opts...) }
+`},
+		},
+		{
+			name: "functional options in a template",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+type Option func(*Thing)
+
+type Thing struct{}
+
+func trace(name string, t *Thing) *Thing { return t }
+
+func NewWithContext(ctx context.Context, opts ...Option) *Thing { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-wrap-expr", `trace("%n", %f(%c, %a))`, "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func New(opts ...Option) *Thing { return trace("New", NewWithContext(context.Background(), opts...)) }
+`},
+		},
+		{
+			name: "function and methods with the same name",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+type Client struct{}
+
+func FetchWithContext(ctx context.Context) error { return nil }
+
+func (c *Client) FetchWithContext(ctx context.Context) error { return nil }
+
+type Server struct{}
+
+func (s *Server) Fetch() error { return nil }
+
+func (s *Server) FetchWithContext(ctx context.Context) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Fetch() error { return FetchWithContext(context.Background()) }
+
+func (c *Client) Fetch() error { return c.FetchWithContext(context.Background()) }
+`},
+			wantLog: []string{"skip Server.FetchWithContext: Server.Fetch is already declared"},
+		},
+		{
+			name: "dot-imported context",
+			files: map[string]string{"a.go": `package p
+
+import . "context"
+
+func DoWithContext(ctx Context, x int) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Do(x int) error { return DoWithContext(context.Background(), x) }
+`},
+		},
+		{
+			name: "methods skipped by out-dir",
+			files: map[string]string{
+				"a.go": `package p
+
+import "context"
+
+type Service struct{}
+
+func (s *Service) GetWithContext(ctx context.Context) error { return nil }
+
+func PutWithContext(ctx context.Context) error { return nil }
+`,
+				"compat/doc.go": "package compat\n",
+			},
+			args: []string{"-f", "a.go", "-out-dir", "compat", "-module", "example.com/p", "-relative-to", ".", "-o", "p.go"},
+			want: map[string]string{"compat/p.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package compat
+
+import (
+	"context"
+	"example.com/p"
+)
+
+func Put() error { return p.PutWithContext(context.Background()) }
+`},
+			wantLog: []string{"skip Service.GetWithContext: -out-dir cannot declare methods of p.Service in package compat"},
+		},
+		{
+			name: "forced names",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func StructWithContext(ctx context.Context) {}
+
+func LenWithContext(ctx context.Context) {}
+
+func GetWithContext(ctx context.Context) {}
+
+type T struct{}
+
+func (T) LenWithContext(ctx context.Context) {}
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-wrapper-visibility", "unexported", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func get() { GetWithContext(context.Background()) }
+
+func (t T) len() { t.LenWithContext(context.Background()) }
+`},
+			wantLog: []string{"skip StructWithContext: struct is a keyword", "skip LenWithContext: len is predeclared"},
+		},
+		{
+			name: "passthrough with an aliased context",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext(ctx context.Context, /* the id */ id int) (context string) { return "" }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-passthrough", "-param-comments", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	stdcontext "context"
+)
+
+func Do(_ stdcontext.Context, id int) (context string) {
+	return DoWithContext(stdcontext.Background(), id)
+}
+`},
+		},
+		{
+			name: "cgo",
+			files: map[string]string{"c.go": `package p
+
+// #include <stdlib.h>
+// typedef int handle;
+import "C"
+
+import "context"
+
+// OpenWithContext opens.
+func OpenWithContext(ctx context.Context, n C.int) error { return nil }
+
+func CloseWithContext(ctx context.Context, h C.handle) error { return nil }
+`},
+			args: []string{"-f", "c.go", "-o", "c_nocontext.go", "-param-comments", "-typecheck"},
+			want: map[string]string{"c_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"C"
+	"context"
+)
+
+func Open(n C.int) error { return OpenWithContext(context.Background(), n) }
+`},
+			wantLog: []string{"skip CloseWithContext: the output cannot refer to C.handle of the cgo preamble"},
+		},
+		{
+			name: "cgo skipped",
+			files: map[string]string{"c.go": `package p
+
+import "C"
+
+import "context"
+
+func OpenWithContext(ctx context.Context, n C.int) error { return nil }
+`},
+			args:    []string{"-f", "c.go", "-o", "c_nocontext.go", "-skip-cgo"},
+			missing: []string{"c_nocontext.go"},
+			wantLog: []string{"c.go: skip the file importing C"},
+		},
+		{
+			name:    "package clause only with -o",
+			files:   map[string]string{"a.go": "package p\n"},
+			args:    []string{"-f", "a.go", "-o", "a_nocontext.go"},
+			missing: []string{"a_nocontext.go"},
+		},
+		{
+			name:    "package clause only with -per-file",
+			files:   map[string]string{"a/a.go": "package a\n", "b/b.go": "package b\n"},
+			args:    []string{"-d", ".", "-r", "-per-file"},
+			missing: []string{"a/a_nocontext.go", "b/b_nocontext.go"},
+		},
+		{
+			name: "inplace",
+			files: map[string]string{"a.go": `// Package store stores the items.
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned for the missing items.
+var ErrNotFound = errors.New("not found")
+
+const (
+	kindA = iota
+	kindB
+)
+
+// Item is an item.
+type Item struct{ ID int }
+
+// GetWithContext returns the item.
+func GetWithContext(ctx context.Context, id int) (*Item, error) {
+	return nil, ErrNotFound
+}
+
+func helper() int { return kindB }
+`},
+			args: []string{"-f", "a.go", "-inplace", "-timeout", "1s", "-typecheck"},
+			want: map[string]string{"a.go": `// Package store stores the items.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned for the missing items.
+var ErrNotFound = errors.New("not found")
+
+const (
+	kindA = iota
+	kindB
+)
+
+// Item is an item.
+type Item struct{ ID int }
+
+// GetWithContext returns the item.
+func GetWithContext(ctx context.Context, id int) (*Item, error) {
+	return nil, ErrNotFound
+}
+
+func helper() int { return kindB }
+
+func Get(id int) (*Item, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return GetWithContext(ctx, id)
+}
+`},
+		},
+		{
+			name: "no parameters",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func DoWithContext() error { return nil }
+
+func GetWithContext(ctx context.Context) error { return nil }
+`},
+			args: []string{"-f", "a.go", "-o", "a_nocontext.go", "-typecheck"},
+			want: map[string]string{"a_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Get() error { return GetWithContext(context.Background()) }
+`},
+			wantLog: []string{"skip DoWithContext: it has no parameters, so it takes no context"},
+		},
+		{
+			name: "source order across files",
+			files: map[string]string{
+				"b.go": `package p
+
+import "context"
+
+func ZetaWithContext(ctx context.Context) error { return nil }
+
+func AlphaWithContext(ctx context.Context) error { return nil }
+
+func MuWithContext(ctx context.Context) error { return nil }
+`,
+				"a.go": `package p
+
+import "context"
+
+func OmegaWithContext(ctx context.Context) error { return nil }
+
+func BetaWithContext(ctx context.Context) error { return nil }
+`,
+			},
+			args: []string{"-d", ".", "-o", "all.go"},
+			want: map[string]string{"all.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Omega() error { return OmegaWithContext(context.Background()) }
+
+func Beta() error { return BetaWithContext(context.Background()) }
+
+func Zeta() error { return ZetaWithContext(context.Background()) }
+
+func Alpha() error { return AlphaWithContext(context.Background()) }
+
+func Mu() error { return MuWithContext(context.Background()) }
+`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			logs, err := runNocontext(t, dir, tt.args...)
+			if err != nil {
+				t.Fatalf("run: %v\n%s", err, logs)
+			}
+			for name, want := range tt.want {
+				if got := readFile(t, filepath.Join(dir, filepath.FromSlash(name))); got != want {
+					t.Errorf("%s:\n%s\nwant:\n%s", name, got, want)
+				}
+			}
+			for _, name := range tt.missing {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+					t.Errorf("%s is created", name)
+				}
+			}
+			for _, want := range tt.wantLog {
+				if !strings.Contains(logs, want) {
+					t.Errorf("log does not contain %q:\n%s", want, logs)
+				}
+			}
+		})
+	}
+}
+
+// TestRerun runs the command twice in the same directory, as go generate does, updating the sources in between.
+// The outputs of the first run must not be taken for the declarations of the sources.
+func TestRerun(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		args  []string
+		// rerunArgs are the arguments of the second run, args if nil.
+		rerunArgs []string
+		// update are the files rewritten before the second run.
+		update map[string]string
+		// want are the contents of the files after both runs by their paths.
+		want map[string]string
+	}{
+		{
+			name: "output in the directory",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func GetWithContext(ctx context.Context) error { return nil }
+`},
+			args: []string{"-d", ".", "-o", "wrappers.go"},
+			want: map[string]string{"wrappers.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Get() error { return GetWithContext(context.Background()) }
+`},
+		},
+		{
+			name: "relative out-dir with per-file",
+			files: map[string]string{
+				"store.go": `package p
+
+import "context"
+
+func PutWithContext(ctx context.Context) error { return nil }
+`,
+				"out/doc.go": "package out\n",
+			},
+			args: []string{"-f", "store.go", "-out-dir", "out", "-module", "example.com/p", "-relative-to", ".", "-per-file"},
+			update: map[string]string{"store.go": `package p
+
+import "context"
+
+func PutWithContext(ctx context.Context) error { return nil }
+
+func GetWithContext(ctx context.Context) error { return nil }
+`},
+			want: map[string]string{"out/store_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package out
+
+import (
+	"context"
+	"example.com/p"
+)
+
+func Put() error { return p.PutWithContext(context.Background()) }
+
+func Get() error { return p.GetWithContext(context.Background()) }
+`},
+		},
+		{
+			name: "same-named files in sibling directories",
+			files: map[string]string{
+				"a/store.go": `package a
+
+import "context"
+
+func GetWithContext(ctx context.Context) error { return nil }
+`,
+				"b/store.go": `package b
+
+import "context"
+
+func PutWithContext(ctx context.Context) error { return nil }
+`,
+			},
+			args: []string{"-d", ".", "-r", "-per-file"},
+			update: map[string]string{"b/store.go": `package b
+
+import "context"
+
+func PutWithContext(ctx context.Context) error { return nil }
+
+func DeleteWithContext(ctx context.Context) error { return nil }
+`},
+			want: map[string]string{
+				"a/store_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package a
+
+import (
+	"context"
+)
+
+func Get() error { return GetWithContext(context.Background()) }
+`,
+				"b/store_nocontext.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package b
+
+import (
+	"context"
+)
+
+func Put() error { return PutWithContext(context.Background()) }
+
+func Delete() error { return DeleteWithContext(context.Background()) }
+`,
+			},
+		},
+		{
+			name: "other output with another suffix",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func GetWithContext(ctx context.Context) error { return nil }
+
+func GetCtx(ctx context.Context, n int) error { return nil }
+
+func PutCtx(ctx context.Context, n int) error { return nil }
+`},
+			args:      []string{"-d", ".", "-o", "ctx.go"},
+			rerunArgs: []string{"-d", ".", "-suffix", "Ctx", "-o", "ctx2.go"},
+			want: map[string]string{"ctx2.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Put(n int) error { return PutCtx(context.Background(), n) }
+`},
+		},
+		{
+			name: "in place after an output",
+			files: map[string]string{"a.go": `package p
+
+import "context"
+
+func GetWithContext(ctx context.Context) error { return nil }
+`},
+			args:      []string{"-d", ".", "-o", "all.go"},
+			rerunArgs: []string{"-d", ".", "-inplace"},
+			want: map[string]string{"a.go": `package p
+
+import "context"
+
+func GetWithContext(ctx context.Context) error { return nil }
+`},
+		},
+		{
+			name: "generated file of another output",
+			files: map[string]string{
+				"a.go": `package p
+
+import "context"
+
+func GetWithContext(ctx context.Context) error { return nil }
+`,
+				"old.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import "context"
+
+func PutWithContext(ctx context.Context) error { return nil }
+`,
+			},
+			args: []string{"-d", ".", "-o", "wrappers.go"},
+			want: map[string]string{"wrappers.go": `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+)
+
+func Get() error { return GetWithContext(context.Background()) }
+`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			if logs, err := runNocontext(t, dir, tt.args...); err != nil {
+				t.Fatalf("first run: %v\n%s", err, logs)
+			}
+			for name, src := range tt.update {
+				if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(src), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rerunArgs := tt.rerunArgs
+			if rerunArgs == nil {
+				rerunArgs = tt.args
+			}
+			if logs, err := runNocontext(t, dir, rerunArgs...); err != nil {
+				t.Fatalf("second run: %v\n%s", err, logs)
+			}
+			for name, want := range tt.want {
+				if got := readFile(t, filepath.Join(dir, filepath.FromSlash(name))); got != want {
+					t.Errorf("%s:\n%s\nwant:\n%s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJobs(t *testing.T) {
+	files := make(map[string]string)
+	for _, pkg := range []string{"a", "b", "c", "d"} {
+		for i := 0; i < 8; i++ {
+			files[fmt.Sprintf("%s/f%d.go", pkg, i)] = fmt.Sprintf(`package %s
+
+import "context"
+
+type T%d struct{}
+
+func (t *T%[2]d) GetWithContext(ctx context.Context, id int) (string, error) { return "", nil }
+
+func Put%[2]dWithContext(ctx context.Context, vs ...string) error { return nil }
+`, pkg, i)
+		}
+	}
+	outputs := func(jobs string) map[string]string {
+		dir := writeFiles(t, files)
+		if logs, err := runNocontext(t, dir, "-d", ".", "-r", "-per-file", "-j", jobs); err != nil {
+			t.Fatalf("-j %s: %v\n%s", jobs, err, logs)
+		}
+		matches, err := filepath.Glob(filepath.Join(dir, "*", "*_nocontext.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs := make(map[string]string)
+		for _, path := range matches {
+			rel, _ := filepath.Rel(dir, path)
+			srcs[rel] = readFile(t, path)
+		}
+		return srcs
+	}
+	serial, parallel := outputs("1"), outputs("8")
+	if len(serial) != 32 {
+		t.Fatalf("-j 1 wrote %d outputs, want 32", len(serial))
+	}
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Errorf("-j 8 wrote\n%v\nwant\n%v", parallel, serial)
+	}
+}
+
+// fuzzPrelude declares the types which the signatures of FuzzWrapper may refer to.
+const fuzzPrelude = `package p
+
+import "context"
+
+type Option func(*S)
+
+type S struct{}
+
+type Cache[K comparable, V any] struct{}
+`
+
+func FuzzWrapper(f *testing.F) {
+	seeds := []struct{ recv, params, results string }{
+		{"", "ctx context.Context", ""},
+		{"", "ctx context.Context", "context string"},
+		{"", "ctx, other context.Context", "error"},
+		{"", "ctx context.Context, _ int, name string", "error"},
+		{"", "context.Context, int, string", "int, error"},
+		{"", "name string, ctx context.Context", "error"},
+		{"", "ctx context.Context, args ...any", ""},
+		{"", "ctx context.Context, opts ...Option", "*S"},
+		{"", "ctx context.Context, req struct{ ID int `json:\"id\"` }", ""},
+		{"", "fn func(ctx context.Context) error", ""},
+		{"", "ctx *context.Context", ""},
+		{"", "ctx context.Context, cancel context.CancelFunc", "context context.Context"},
+		{"s *S", "ctx context.Context, s2 S", "s3 S, err error"},
+		{"S", "_ context.Context, s *S", ""},
+		{"*Cache[K, V]", "ctx context.Context, k K", "V"},
+		{"c Cache[K, _]", "ctx context.Context, k K", "K"},
+		{"", "", "error"},
+	}
+	for _, seed := range seeds {
+		f.Add(seed.recv, seed.params, seed.results)
+	}
+	// The importer is shared by the inputs, so that context is type-checked from source only once.
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+	opts := Options{Suffix: "WithContext", Sort: "source", CtxExpr: "context.Background()", Visibility: "inherit"}
+	check := func(files ...*ast.File) error {
+		conf := types.Config{Importer: imp}
+		_, err := conf.Check("p", fset, files, nil)
+		return err
+	}
+	f.Fuzz(func(t *testing.T, recv, params, results string) {
+		if recv != "" {
+			recv = "(" + recv + ") "
+		}
+		src := fuzzPrelude + "\nfunc " + recv + "DoWithContext(" + params + ") (" + results + ") { panic(0) }\n"
+		// Only the valid signatures are wrapped, and only the ones which run would wrap.
+		file, err := parser.ParseFile(fset, "a.go", src, 0)
+		if err != nil || check(file) != nil {
+			t.Skip()
+		}
+		fdecl := file.Decls[len(file.Decls)-1].(*ast.FuncDecl)
+		imports := fileImports(file)
+		ctxPointer, reason := contextParam(fdecl, imports, opts.CtxPointer)
+		if reason != "" {
+			t.Skip()
+		}
+		out := &output{path: "a_nocontext.go", pkgName: "p", targets: []*target{{decl: detach(fdecl), imports: imports, suffix: opts.Suffix, ctxPointer: ctxPointer}}}
+		gen, err := generate(fset, out, opts)
+		if err != nil {
+			t.Fatalf("%s\n%v", src, err)
+		}
+		// The wrapper shares the signature with fdecl, so the source is parsed again to be checked with it.
+		file, err = parser.ParseFile(fset, "a.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		genFile, err := parser.ParseFile(fset, out.path, gen, 0)
+		if err != nil {
+			t.Fatalf("%s\n%v\n%s", src, err, gen)
+		}
+		if err := check(file, genFile); err != nil {
+			t.Fatalf("%s\n%v\n%s", src, err, gen)
+		}
+	})
+}
+
+func TestUniqueFiles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := uniqueFiles([]string{"a.go", "./a.go", "b.go", filepath.Join(wd, "a.go"), "sub/../b.go", "sub/a.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.go", "b.go", "sub/a.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// syntheticSource returns a file of the package p declaring n functions named with suffix,
+// taking a context and up to 32 other parameters, as generated RPC clients do.
+func syntheticSource(n int, suffix string) string {
+	var b strings.Builder
+	b.WriteString("package p\n\nimport \"context\"\n\ntype Request struct{ ID int }\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "\n// Call%d%s calls the method %[1]d.\nfunc Call%[1]d%[2]s(ctx context.Context", i, suffix)
+		for j := 0; j < i%33; j++ {
+			fmt.Fprintf(&b, ", p%d *Request", j)
+		}
+		b.WriteString(") (*Request, error) {\n\tif ctx == nil {\n\t\treturn nil, nil\n\t}\n\treturn &Request{}, nil\n}\n")
+	}
+	return b.String()
+}
+
+func BenchmarkGenerate500(b *testing.B) {
+	dir := writeFiles(b, map[string]string{"p.go": syntheticSource(500, "WithContext")})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if logs, err := runNocontext(b, dir, "-f", "p.go", "-o", "p_nocontext.go"); err != nil {
+			b.Fatalf("%v\n%s", err, logs)
+		}
+	}
+}
+
+func BenchmarkParseFile(b *testing.B) {
+	src := syntheticSource(500, "WithContext")
+	for _, bm := range []struct {
+		name string
+		mode parser.Mode
+	}{
+		{"resolve", 0},
+		{"skip-resolution", parser.SkipObjectResolution},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.ParseFile(token.NewFileSet(), "p.go", src, bm.mode); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPrescan parses a file without the suffix, which the pre-scan parses up to its package clause only.
+func BenchmarkPrescan(b *testing.B) {
+	dir := writeFiles(b, map[string]string{"p.go": syntheticSource(500, "")})
+	path := filepath.Join(dir, "p.go")
+	for _, bm := range []struct {
+		name, suffix string
+	}{
+		{"full", ""},
+		{"prescan", "WithContext"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := parseFile(token.NewFileSet(), path, false, bm.suffix); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"go/token"
+	"sort"
+)
+
+// manifestWrapper describes a wrapper in the -manifest file.
+type manifestWrapper struct {
+	Name string `json:"name"`
+	// Recv is the receiver type name of a method wrapper.
+	Recv string `json:"recv,omitempty"`
+	// Wraps is the name of the wrapped function.
+	Wraps string `json:"wraps"`
+	// Source is the position of the wrapped function, which is empty for the methods promoted by -promote.
+	Source string `json:"source,omitempty"`
+	Output string `json:"output"`
+}
+
+type manifestPackage struct {
+	Dir      string            `json:"dir"`
+	Package  string            `json:"package"`
+	Wrappers []manifestWrapper `json:"wrappers"`
+}
+
+// manifest lists the wrappers of outputs by the package of the wrapped functions, sorted by directory.
+// It must be called before the generation, which renames the declarations of the targets.
+func manifest(fset *token.FileSet, outputs []*output, opts Options) []*manifestPackage {
+	pkgs := []*manifestPackage{}
+	byKey := make(map[string]*manifestPackage)
+	for _, out := range outputs {
+		for _, t := range out.targets {
+			dir, name := sourcePackage(fset, out, t)
+			key := dir + "\x00" + name
+			pkg, ok := byKey[key]
+			if !ok {
+				pkg = &manifestPackage{Dir: dir, Package: name}
+				byKey[key] = pkg
+				pkgs = append(pkgs, pkg)
+			}
+			w := manifestWrapper{Name: t.wrapperName(opts), Recv: t.wrapperRecv(opts), Wraps: t.decl.Name.Name, Output: out.displayPath()}
+			if pos := t.decl.Pos(); pos.IsValid() {
+				w.Source = fset.Position(pos).String()
+			}
+			pkg.Wrappers = append(pkg.Wrappers, w)
+		}
+	}
+	sort.SliceStable(pkgs, func(i, j int) bool { return pkgs[i].Dir < pkgs[j].Dir })
+	return pkgs
+}
+
+// writeManifest writes pkgs as indented JSON to the file at path, or to the standard output for -.
+func writeManifest(path string, pkgs []*manifestPackage) error {
+	b, err := json.MarshalIndent(struct {
+		Packages []*manifestPackage `json:"packages"`
+	}{pkgs}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		path = ""
+	}
+	return writeOutput(path, append(b, '\n'))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// importKey identifies an import spec by its name and path.
+func importKey(spec *ast.ImportSpec) string {
+	path, _ := strconv.Unquote(spec.Path.Value)
+	name := importName(path)
+	if spec.Name != nil {
+		name = spec.Name.Name
+	}
+	return name + " " + path
+}
+
+// importLine returns the source of spec.
+func importLine(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name + " " + spec.Path.Value
+	}
+	return spec.Path.Value
+}
+
+// isStdImport reports whether path is of the standard library, whose first element has no dot.
+func isStdImport(path string) bool {
+	first := path
+	if i := strings.Index(path, "/"); i >= 0 {
+		first = path[:i]
+	}
+	return !strings.Contains(first, ".")
+}
+
+// importGroups splits the specs of the parenthesized import declaration gdecl at blank lines and comments.
+func importGroups(fset *token.FileSet, gdecl *ast.GenDecl) [][]*ast.ImportSpec {
+	var groups [][]*ast.ImportSpec
+	prevLine := 0
+	for _, spec := range gdecl.Specs {
+		spec := spec.(*ast.ImportSpec)
+		start := spec.Pos()
+		if spec.Doc != nil {
+			start = spec.Doc.Pos()
+		}
+		if len(groups) == 0 || fset.Position(start).Line > prevLine+1 {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], spec)
+		prevLine = fset.Position(spec.End()).Line
+		if spec.Comment != nil {
+			prevLine = fset.Position(spec.Comment.End()).Line
+		}
+	}
+	return groups
+}
+
+// insertion is a text inserted into a source at an offset.
+type insertion struct {
+	offset int
+	text   string
+}
+
+// groupImports places the missing imports into the groups of the parenthesized import declaration gdecl,
+// in the sorted position of the first group of the standard library for standard ones,
+// or of the last group with other imports for the others, starting a new group if there is none.
+// The context import is placed in a group of its own after the others if ctxGroup is "separate".
+// It returns nil if the groups cannot be told apart, e.g. when the specs share lines.
+func groupImports(fset *token.FileSet, gdecl *ast.GenDecl, missing []*ast.ImportSpec, ctxGroup string) []insertion {
+	tf := fset.File(gdecl.Pos())
+	groups := importGroups(fset, gdecl)
+	for _, group := range groups {
+		for i := 1; i < len(group); i++ {
+			if tf.Line(group[i].Pos()) == tf.Line(group[i-1].End()) {
+				return nil
+			}
+		}
+	}
+	if len(groups) == 0 || tf.Line(gdecl.Rparen) == tf.Line(gdecl.Specs[len(gdecl.Specs)-1].End()) {
+		return nil
+	}
+	lineStart := func(pos token.Pos) int { return tf.Offset(tf.LineStart(tf.Line(pos))) }
+	nextLine := func(pos token.Pos) int { return tf.Offset(tf.LineStart(tf.Line(pos) + 1)) }
+	groupPath := func(spec *ast.ImportSpec) string {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		return path
+	}
+
+	std, other := -1, -1
+	for i, group := range groups {
+		allStd := true
+		for _, spec := range group {
+			allStd = allStd && isStdImport(groupPath(spec))
+		}
+		if allStd && std < 0 {
+			std = i
+		}
+		if !allStd {
+			other = i
+		}
+	}
+
+	var inserts []insertion
+	var newGroup []string
+	for _, spec := range missing {
+		path := groupPath(spec)
+		line := "\t" + importLine(spec) + "\n"
+		g := other
+		if isStdImport(path) {
+			g = std
+		}
+		if path == contextPath && ctxGroup == "separate" || g < 0 {
+			newGroup = append(newGroup, line)
+			continue
+		}
+		group := groups[g]
+		offset := nextLine(group[len(group)-1].End())
+		for _, existing := range group {
+			if groupPath(existing) > path {
+				start := existing.Pos()
+				if existing.Doc != nil {
+					start = existing.Doc.Pos()
+				}
+				offset = lineStart(start)
+				break
+			}
+		}
+		inserts = append(inserts, insertion{offset: offset, text: line})
+	}
+	if len(newGroup) > 0 {
+		sort.Strings(newGroup)
+		inserts = append(inserts, insertion{offset: lineStart(gdecl.Rparen), text: "\n" + strings.Join(newGroup, "")})
+	}
+	return inserts
+}
+
+// style is the indentation and the line ending of a file.
+type style struct {
+	indent, newline string
+}
+
+// gofmtStyle is the style of gofmt.
+var gofmtStyle = style{indent: "\t", newline: "\n"}
+
+// detectStyle returns the style of src, which is indented by the leading tab or spaces of its first indented line,
+// apart from the lines continuing block comments.
+func detectStyle(src []byte) style {
+	st := gofmtStyle
+	if bytes.Contains(src, []byte("\r\n")) {
+		st.newline = "\r\n"
+	}
+	for _, line := range strings.Split(string(src), "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || trimmed == "\r" || len(trimmed) == len(line) || strings.HasPrefix(trimmed, "*") {
+			continue
+		}
+		if line[0] == ' ' {
+			st.indent = line[:len(line)-len(strings.TrimLeft(line, " "))]
+		}
+		break
+	}
+	return st
+}
+
+// apply converts text in gofmtStyle to st.
+func (st style) apply(text string) string {
+	if st == gofmtStyle {
+		return text
+	}
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		n := len(line) - len(strings.TrimLeft(line, "\t"))
+		line = strings.Repeat(st.indent, n) + line[n:]
+		if strings.HasSuffix(line, "\n") && !strings.HasSuffix(line, "\r\n") {
+			line = line[:len(line)-1] + st.newline
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "")
+}
+
+// mergeGenerated appends the declarations of the generated file gen to the existing file src,
+// adding the imports of gen which src lacks. The rest of src is left as is.
+// The imports are placed into the existing groups as described by groupImports.
+// The result is formatted by gofmt, unless keepFormat is set, in which case the inserted text
+// follows the indentation and the line endings of src, and the rest of it is kept byte for byte.
+func mergeGenerated(src, gen []byte, ctxGroup string, keepFormat bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "existing.go", src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parse existing file: %w", err)
+	}
+	g, err := parser.ParseFile(fset, "generated.go", gen, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parse generated code: %w", err)
+	}
+
+	existing := make(map[string]bool)
+	for _, spec := range f.Imports {
+		existing[importKey(spec)] = true
+	}
+	var missing []*ast.ImportSpec
+	for _, spec := range g.Imports {
+		if !existing[importKey(spec)] {
+			missing = append(missing, spec)
+		}
+	}
+
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+	st := gofmtStyle
+	if keepFormat {
+		st = detectStyle(src)
+	}
+
+	var buf bytes.Buffer
+	rest := 0
+	if len(missing) > 0 {
+		var lastImport *ast.GenDecl
+		for _, decl := range f.Decls {
+			if gdecl, ok := decl.(*ast.GenDecl); ok && gdecl.Tok == token.IMPORT {
+				lastImport = gdecl
+			}
+		}
+		var inserts []insertion
+		if lastImport != nil && lastImport.Rparen.IsValid() {
+			inserts = groupImports(fset, lastImport, missing, ctxGroup)
+		}
+		switch {
+		case inserts != nil:
+			sort.SliceStable(inserts, func(i, j int) bool { return inserts[i].offset < inserts[j].offset })
+			for _, ins := range inserts {
+				buf.Write(src[rest:ins.offset])
+				buf.WriteString(st.apply(ins.text))
+				rest = ins.offset
+			}
+		case lastImport != nil && lastImport.Rparen.IsValid():
+			rest = offset(lastImport.Rparen)
+			buf.Write(src[:rest])
+			for _, spec := range missing {
+				buf.WriteString(st.apply("\t" + importLine(spec) + "\n"))
+			}
+		case lastImport != nil:
+			rest = offset(lastImport.End())
+			buf.Write(src[:rest])
+			for _, spec := range missing {
+				buf.WriteString(st.apply("\nimport " + importLine(spec)))
+			}
+		default:
+			rest = offset(f.Name.End())
+			buf.Write(src[:rest])
+			buf.WriteString(st.apply("\n\nimport (\n"))
+			for _, spec := range missing {
+				buf.WriteString(st.apply("\t" + importLine(spec) + "\n"))
+			}
+			buf.WriteString(")")
+		}
+	}
+	buf.Write(src[rest:])
+
+	for _, decl := range g.Decls {
+		if gdecl, ok := decl.(*ast.GenDecl); ok && gdecl.Tok == token.IMPORT {
+			continue
+		}
+		start := decl.Pos()
+		if fdecl, ok := decl.(*ast.FuncDecl); ok && fdecl.Doc != nil {
+			start = fdecl.Doc.Pos()
+		}
+		buf.WriteString(st.apply("\n" + string(gen[offset(start):offset(decl.End())]) + "\n"))
+	}
+	if keepFormat {
+		return buf.Bytes(), nil
+	}
+	return format.Source(buf.Bytes())
+}
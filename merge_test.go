@@ -0,0 +1,132 @@
+package main
+
+import "testing"
+
+func TestMergeGenerated(t *testing.T) {
+	gen := `// Code generated by nocontext. DO NOT EDIT.
+
+package p
+
+import (
+	"context"
+	"time"
+)
+
+func Put(it *Item) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return PutWithContext(ctx, it)
+}
+`
+	tests := []struct {
+		name       string
+		src        string
+		keepFormat bool
+		want       string
+	}{
+		{
+			name: "single import",
+			src: `package p
+
+import "context"
+
+const (
+	kindA = iota
+	kindB
+)
+
+type Item struct{ ID int }
+
+var items = map[int]*Item{}
+
+func helper() int { return kindB }
+
+func Get(id int) (*Item, error) { return GetWithContext(context.Background(), id) }
+`,
+			want: `package p
+
+import "context"
+import "time"
+
+const (
+	kindA = iota
+	kindB
+)
+
+type Item struct{ ID int }
+
+var items = map[int]*Item{}
+
+func helper() int { return kindB }
+
+func Get(id int) (*Item, error) { return GetWithContext(context.Background(), id) }
+
+func Put(it *Item) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return PutWithContext(ctx, it)
+}
+`,
+		},
+		{
+			name: "import groups",
+			src: `package p
+
+import (
+	"context"
+	"errors"
+
+	"example.com/lib"
+)
+
+// ErrNotFound is returned for the missing items.
+var ErrNotFound = errors.New("not found")
+
+type Item struct{ ID lib.ID }
+
+func helper() int   { return 1 }
+func helper2() bool { return true }
+
+func Get(id int) (*Item, error) { return GetWithContext(context.Background(), id) }
+`,
+			keepFormat: true,
+			want: `package p
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"example.com/lib"
+)
+
+// ErrNotFound is returned for the missing items.
+var ErrNotFound = errors.New("not found")
+
+type Item struct{ ID lib.ID }
+
+func helper() int   { return 1 }
+func helper2() bool { return true }
+
+func Get(id int) (*Item, error) { return GetWithContext(context.Background(), id) }
+
+func Put(it *Item) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return PutWithContext(ctx, it)
+}
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeGenerated([]byte(tt.src), []byte(gen), "", tt.keepFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
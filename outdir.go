@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// validateModulePath checks that module looks like a module path given to -module.
+func validateModulePath(module string) error {
+	if module == "" {
+		return fmt.Errorf("empty module path")
+	}
+	if strings.ContainsAny(module, "\\ \t") || strings.HasPrefix(module, "/") || strings.HasSuffix(module, "/") {
+		return fmt.Errorf("%q is not a module path", module)
+	}
+	for _, elem := range strings.Split(module, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("%q is not a module path", module)
+		}
+	}
+	return nil
+}
+
+// importPath returns the import path of the package in dir, computed from its location
+// relative to the module root and the module path, so that the go command is not needed.
+func importPath(module, root, dir string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("resolve module root: %w", err)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolve source directory: %w", err)
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the module root %s", dir, root)
+	}
+	if rel == "." {
+		return module, nil
+	}
+	return path.Join(module, filepath.ToSlash(rel)), nil
+}
+
+// outPackageName returns the name of the package generated into dir by -out-dir, which is its base name.
+func outPackageName(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolve output directory: %w", err)
+	}
+	name := filepath.Base(abs)
+	if !token.IsIdentifier(name) {
+		return "", fmt.Errorf("the base name of %s is not a valid package name", dir)
+	}
+	return name, nil
+}
+
+// checkDir checks that dir is an existing directory.
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// typeParamNames returns the names of the type parameters of ftype.
+func typeParamNames(ftype *ast.FuncType) map[string]bool {
+	names := make(map[string]bool)
+	if ftype.TypeParams != nil {
+		for _, field := range ftype.TypeParams.List {
+			for _, name := range field.Names {
+				names[name.Name] = true
+			}
+		}
+	}
+	return names
+}
+
+// mapLocal replaces each identifier in the type expression expr referring to a package-level declaration,
+// i.e. neither predeclared nor in scope like the type parameters, by the result of f.
+func mapLocal(expr ast.Expr, scope map[string]bool, f func(*ast.Ident) ast.Expr) ast.Expr {
+	switch x := expr.(type) {
+	case *ast.Ident:
+		if scope[x.Name] || types.Universe.Lookup(x.Name) != nil {
+			return x
+		}
+		return f(x)
+	case *ast.StarExpr:
+		x.X = mapLocal(x.X, scope, f)
+	case *ast.ParenExpr:
+		x.X = mapLocal(x.X, scope, f)
+	case *ast.UnaryExpr:
+		x.X = mapLocal(x.X, scope, f)
+	case *ast.BinaryExpr:
+		x.X = mapLocal(x.X, scope, f)
+		x.Y = mapLocal(x.Y, scope, f)
+	case *ast.ArrayType:
+		if x.Len != nil {
+			x.Len = mapLocal(x.Len, scope, f)
+		}
+		x.Elt = mapLocal(x.Elt, scope, f)
+	case *ast.Ellipsis:
+		if x.Elt != nil {
+			x.Elt = mapLocal(x.Elt, scope, f)
+		}
+	case *ast.MapType:
+		x.Key = mapLocal(x.Key, scope, f)
+		x.Value = mapLocal(x.Value, scope, f)
+	case *ast.ChanType:
+		x.Value = mapLocal(x.Value, scope, f)
+	case *ast.FuncType:
+		mapLocalFields(x.Params, scope, f)
+		mapLocalFields(x.Results, scope, f)
+	case *ast.StructType:
+		mapLocalFields(x.Fields, scope, f)
+	case *ast.InterfaceType:
+		mapLocalFields(x.Methods, scope, f)
+	case *ast.IndexExpr:
+		x.X = mapLocal(x.X, scope, f)
+		x.Index = mapLocal(x.Index, scope, f)
+	case *ast.IndexListExpr:
+		x.X = mapLocal(x.X, scope, f)
+		for i, index := range x.Indices {
+			x.Indices[i] = mapLocal(index, scope, f)
+		}
+	case *ast.CallExpr:
+		// e.g. unsafe.Sizeof(T{}) as an array length
+		x.Fun = mapLocal(x.Fun, scope, f)
+		for i, arg := range x.Args {
+			x.Args[i] = mapLocal(arg, scope, f)
+		}
+	}
+	return expr
+}
+
+// mapLocalFields applies mapLocal to the types of list.
+func mapLocalFields(list *ast.FieldList, scope map[string]bool, f func(*ast.Ident) ast.Expr) {
+	if list == nil {
+		return
+	}
+	for _, field := range list.List {
+		field.Type = mapLocal(field.Type, scope, f)
+	}
+}
+
+// mapSignature applies mapLocal to the type parameter constraints, the parameters and the results of fdecl.
+func mapSignature(fdecl *ast.FuncDecl, f func(*ast.Ident) ast.Expr) {
+	scope := typeParamNames(fdecl.Type)
+	mapLocalFields(fdecl.Type.TypeParams, scope, f)
+	mapLocalFields(fdecl.Type.Params, scope, f)
+	mapLocalFields(fdecl.Type.Results, scope, f)
+}
+
+// unexportedRefs returns the unexported package-level identifiers referred to by the signature of fdecl,
+// which cannot be referred to from another package.
+func unexportedRefs(fdecl *ast.FuncDecl) []string {
+	var names []string
+	mapSignature(fdecl, func(ident *ast.Ident) ast.Expr {
+		if !ident.IsExported() {
+			names = append(names, ident.Name)
+		}
+		return ident
+	})
+	return names
+}
+
+// qualifyLocal qualifies the package-level identifiers in the signature of fdecl by the package qualifier.
+func qualifyLocal(fdecl *ast.FuncDecl, qualifier string) {
+	mapSignature(fdecl, func(ident *ast.Ident) ast.Expr {
+		return &ast.SelectorExpr{X: ast.NewIdent(qualifier), Sel: ident}
+	})
+}
+
+// sourceName returns the qualifier of the source package named name in the output of targets generated by -out-dir.
+// It is aliased if a parameter shadows it or the sources import another package with the name.
+func sourceName(name, path string, targets []*target) string {
+	for _, t := range targets {
+		if spec, ok := t.imports[name]; (ok && spec.path != path) || t.declares(name, true) {
+			return "src" + name
+		}
+	}
+	return name
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// promoteSpec is a struct type and its interface field given to -promote as Type.Field.
+type promoteSpec struct {
+	typeName, field string
+}
+
+func parsePromoteSpecs(s string) ([]promoteSpec, error) {
+	var specs []promoteSpec
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, ".")
+		if i <= 0 || i == len(item)-1 {
+			return nil, fmt.Errorf("%q is not of the form Type.Field", item)
+		}
+		specs = append(specs, promoteSpec{typeName: item[:i], field: item[i+1:]})
+	}
+	return specs, nil
+}
+
+// promoteTargets adds the targets wrapping the methods with opts.Suffix of the interface fields given by specs
+// in the package pkgName in dir, which are forwarded through the fields as methods of the outer types.
+// The method sets are resolved by type-checking the package without the files in excluded.
+// The targets are added to the output returned by outputFor for the file declaring the outer type.
+// It returns the specs whose types are declared in the package.
+func promoteTargets(dir, pkgName string, specs []promoteSpec, opts Options, excluded map[string]bool, outputFor func(file string) *output) ([]promoteSpec, error) {
+	fset := token.NewFileSet()
+	files, err := packageFiles(fset, dir, pkgName, excluded)
+	if err != nil {
+		return nil, fmt.Errorf("-promote: %w", err)
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	pkg, _ := conf.Check(dir, fset, files, nil)
+
+	var found []promoteSpec
+	for _, spec := range specs {
+		obj, ok := pkg.Scope().Lookup(spec.typeName).(*types.TypeName)
+		if !ok {
+			continue
+		}
+		found = append(found, spec)
+		out := outputFor(fset.Position(obj.Pos()).Filename)
+		named, ok := obj.Type().(*types.Named)
+		if !ok || named.TypeParams().Len() > 0 {
+			return nil, fmt.Errorf("-promote: %s is not a non-generic defined type", spec.typeName)
+		}
+		st, ok := named.Underlying().(*types.Struct)
+		if !ok {
+			return nil, fmt.Errorf("-promote: %s is not a struct", spec.typeName)
+		}
+		var field *types.Var
+		for i := 0; i < st.NumFields(); i++ {
+			if st.Field(i).Name() == spec.field {
+				field = st.Field(i)
+			}
+		}
+		if field == nil {
+			return nil, fmt.Errorf("-promote: %s has no field %s", spec.typeName, spec.field)
+		}
+		iface, ok := field.Type().Underlying().(*types.Interface)
+		if !ok {
+			return nil, fmt.Errorf("-promote: %s.%s is not an interface", spec.typeName, spec.field)
+		}
+
+		pointer := false
+		for i := 0; i < named.NumMethods(); i++ {
+			if _, ok := named.Method(i).Type().(*types.Signature).Recv().Type().(*types.Pointer); ok {
+				pointer = true
+			}
+		}
+		for i := 0; i < iface.NumMethods(); i++ {
+			m := iface.Method(i)
+			if !m.Exported() || !strings.HasSuffix(m.Name(), opts.Suffix) || m.Name() == opts.Suffix {
+				continue
+			}
+			sig := m.Type().(*types.Signature)
+			if sig.Params().Len() == 0 || !isContextObj(sig.Params().At(0).Type()) {
+				continue
+			}
+			t := promotedTarget(pkg, spec, pointer, m.Name(), sig)
+			if !opts.selects(m.Name()) || opts.RequireError && !returnsError(t.decl) {
+				continue
+			}
+			t.suffix = opts.Suffix
+			out.targets = append(out.targets, t)
+		}
+	}
+	return found, nil
+}
+
+// isContextObj reports whether typ is context.Context.
+func isContextObj(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == contextPath && named.Obj().Name() == "Context"
+}
+
+// promotedTarget synthesizes the declaration of the method name with sig as if it was declared on spec.typeName,
+// so that the wrapper is generated as for a declared method calling through spec.field.
+func promotedTarget(pkg *types.Package, spec promoteSpec, pointer bool, name string, sig *types.Signature) *target {
+	imports := make(map[string]importSpec)
+	qualifier := func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		imports[p.Name()] = importSpec{path: p.Path(), explicit: p.Name() != importName(p.Path())}
+		return p.Name()
+	}
+	typeExpr := func(typ types.Type) ast.Expr {
+		expr, err := parser.ParseExpr(types.TypeString(typ, qualifier))
+		if err != nil {
+			panic(fmt.Sprintf("parse type %s: %v", typ, err))
+		}
+		resetPos(expr)
+		return expr
+	}
+	fieldList := func(tuple *types.Tuple, variadic bool) *ast.FieldList {
+		list := &ast.FieldList{}
+		for i := 0; i < tuple.Len(); i++ {
+			v := tuple.At(i)
+			field := &ast.Field{}
+			if v.Name() != "" {
+				field.Names = []*ast.Ident{ast.NewIdent(v.Name())}
+			}
+			if variadic && i == tuple.Len()-1 {
+				field.Type = &ast.Ellipsis{Elt: typeExpr(v.Type().(*types.Slice).Elem())}
+			} else {
+				field.Type = typeExpr(v.Type())
+			}
+			list.List = append(list.List, field)
+		}
+		return list
+	}
+
+	params := fieldList(sig.Params(), sig.Variadic())
+	// The parameters are either all named or all unnamed, and the context is stripped anyway.
+	if len(params.List[0].Names) == 0 {
+		params.List[0].Names = []*ast.Ident{ast.NewIdent("_")}
+		for _, param := range params.List[1:] {
+			param.Names = []*ast.Ident{ast.NewIdent("_")}
+		}
+	}
+	var results *ast.FieldList
+	if sig.Results().Len() > 0 {
+		results = fieldList(sig.Results(), false)
+	}
+
+	fdecl := &ast.FuncDecl{
+		Name: ast.NewIdent(name),
+		Type: &ast.FuncType{Params: params, Results: results},
+	}
+	var recvType ast.Expr = ast.NewIdent(spec.typeName)
+	if pointer {
+		recvType = &ast.StarExpr{X: recvType}
+	}
+	fdecl.Recv = &ast.FieldList{List: []*ast.Field{{Type: recvType}}}
+	t := &target{decl: fdecl, imports: imports, field: spec.field}
+	t.nameRecv()
+	return t
+}
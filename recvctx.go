@@ -0,0 +1,36 @@
+package main
+
+import (
+	"go/ast"
+	"log"
+)
+
+// useRecvCtx makes the method wrappers of outputs pass the context returned by the method accessor of their receivers,
+// given by -recv-ctx, instead of the context expression, unless a directive or a config comment overrides it.
+// The receiver types without the method are warned about once, and their wrappers keep the context expression.
+func useRecvCtx(outputs []*output, indexes map[string]*declIndex, accessor string) {
+	warned := make(map[string]bool)
+	for _, out := range outputs {
+		idx := indexes[out.dir]
+		for _, t := range out.targets {
+			recv := t.recvTypeName()
+			if recv == "" || t.ctxExpr != "" {
+				continue
+			}
+			if idx == nil || !idx.declared(recv, accessor) {
+				if !warned[out.dir+"\x00"+recv] {
+					warned[out.dir+"\x00"+recv] = true
+					log.Printf("%s: %s has no method %s, so its wrappers pass the context expression", out.displayPath(), recv, accessor)
+				}
+				continue
+			}
+			t.recvCtx = accessor
+		}
+	}
+}
+
+// recvCtxExpr returns the call of the accessor of t on its receiver, which must be named.
+func (t *target) recvCtxExpr() ast.Expr {
+	recv := t.decl.Recv.List[0].Names[0]
+	return &ast.CallExpr{Fun: &ast.SelectorExpr{X: ast.NewIdent(recv.Name), Sel: ast.NewIdent(t.recvCtx)}}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"log"
+)
+
+// registered returns the names of the wrappers of decls registered by -registry,
+// which are the functions other than the generic ones, since neither they nor the methods are values by themselves.
+func registered(decls []*ast.FuncDecl, displayPath string, verbose bool) []string {
+	var names []string
+	for _, fdecl := range decls {
+		switch {
+		case fdecl.Recv != nil:
+		case fdecl.Type.TypeParams != nil:
+			if verbose {
+				log.Printf("%s: %s is not registered, since it is generic", displayPath, fdecl.Name.Name)
+			}
+		default:
+			names = append(names, fdecl.Name.Name)
+		}
+	}
+	return names
+}
+
+// writeRegistryInit writes the init function storing the wrappers into the map variable registry by name,
+// if there are any.
+func writeRegistryInit(buf *bytes.Buffer, registry string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	buf.WriteString("\nfunc init() {\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "\t%s[%q] = %s\n", registry, name, name)
+	}
+	buf.WriteString("}\n")
+}
+
+// checkRegistry checks that the map variable of Options.Registry is declared in the package of each output registering wrappers.
+func checkRegistry(outputs []*output, indexes map[string]*declIndex, opts Options) error {
+	registry := opts.Registry
+	for _, out := range outputs {
+		hasFunc := false
+		for _, t := range out.targets {
+			hasFunc = hasFunc || t.wrapperRecv(opts) == "" && t.decl.Type.TypeParams == nil
+		}
+		if idx := indexes[out.dir]; hasFunc && (idx == nil || !idx.vars[registry]) {
+			return fmt.Errorf("%s: %s is not declared as a variable in package %s", out.displayPath(), registry, out.pkgName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+)
+
+// replaceContextCalls rewrites the calls of context.<from>() in the files generated by nocontext among fileNames
+// to context.<to>(), e.g. Background to TODO. Only the names of the functions are replaced,
+// so that the rest of the files, including any hand-tweaks, is kept as is.
+func replaceContextCalls(fileNames []string, from, to string, verbose bool) error {
+	for _, fpath := range fileNames {
+		src, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return fmt.Errorf("read file: %w", err)
+		}
+		if !isGenerated(src) {
+			continue
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, fpath, src, parser.SkipObjectResolution)
+		if err != nil {
+			return fmt.Errorf("parse generated file: %w", err)
+		}
+		imports := fileImports(f)
+		var offsets []int
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) > 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != from {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && imports[x.Name].path == contextPath {
+				offsets = append(offsets, fset.Position(sel.Sel.Pos()).Offset)
+			}
+			return true
+		})
+		if len(offsets) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		rest := 0
+		for _, offset := range offsets {
+			buf.Write(src[rest:offset])
+			buf.WriteString(to)
+			rest = offset + len(from)
+		}
+		buf.Write(src[rest:])
+		if err := writeOutput(fpath, buf.Bytes()); err != nil {
+			return err
+		}
+		if verbose {
+			log.Printf("%s: replace %d calls of context.%s by context.%s", fpath, len(offsets), from, to)
+		}
+	}
+	return nil
+}
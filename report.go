@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reportFile is the result of an output in the -report-file.
+type reportFile struct {
+	Output string `json:"output"`
+	// Wrappers are the names of the wrappers in the output, qualified by their receiver types.
+	Wrappers []string `json:"wrappers"`
+	// Error is the reason why the output could not be written, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// report is the summary of a run written by -report-file.
+type report struct {
+	// Args are the arguments nocontext was invoked with.
+	Args   []string     `json:"args"`
+	Files  []reportFile `json:"files"`
+	Totals struct {
+		Outputs  int `json:"outputs"`
+		Wrappers int `json:"wrappers"`
+		Failed   int `json:"failed"`
+	} `json:"totals"`
+}
+
+// wrapperNames returns the qualified names of the wrappers of out.
+// It must be called before the generation, which renames the declarations of the targets.
+func wrapperNames(out *output, opts Options) []string {
+	names := []string{}
+	for _, t := range out.targets {
+		names = append(names, qualifiedName(t.wrapperRecv(opts), t.wrapperName(opts)))
+	}
+	return names
+}
+
+// newReport summarizes the run with args writing outputs, whose wrappers are listed by names, and which failed with errs.
+func newReport(args []string, outputs []*output, names map[*output][]string, errs map[*output]error) *report {
+	r := &report{Args: args, Files: []reportFile{}}
+	for _, out := range outputs {
+		f := reportFile{Output: out.displayPath(), Wrappers: names[out]}
+		if f.Wrappers == nil {
+			f.Wrappers = []string{}
+		}
+		if err := errs[out]; err != nil {
+			f.Error = err.Error()
+			r.Totals.Failed++
+		}
+		r.Files = append(r.Files, f)
+		r.Totals.Outputs++
+		r.Totals.Wrappers += len(f.Wrappers)
+	}
+	return r
+}
+
+// write writes r to the file at path, creating its directory, as indented JSON if path ends with .json, or as text.
+func (r *report) write(path string) error {
+	var b []byte
+	if strings.HasSuffix(path, ".json") {
+		var err error
+		if b, err = json.MarshalIndent(r, "", "\t"); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	} else {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "nocontext %s\n", strings.Join(r.Args, " "))
+		for _, f := range r.Files {
+			switch {
+			case f.Error != "":
+				fmt.Fprintf(&sb, "%s: failed: %s\n", f.Output, f.Error)
+			case len(f.Wrappers) == 0:
+				fmt.Fprintf(&sb, "%s: no wrappers\n", f.Output)
+			default:
+				fmt.Fprintf(&sb, "%s: %s\n", f.Output, strings.Join(f.Wrappers, ", "))
+			}
+		}
+		fmt.Fprintf(&sb, "%d outputs, %d wrappers, %d failed\n", r.Totals.Outputs, r.Totals.Wrappers, r.Totals.Failed)
+		b = []byte(sb.String())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	return writeOutput(path, b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// counts are the numbers reported by -stats-json.
+type counts struct {
+	// Exported is the number of exported functions and methods.
+	Exported int `json:"exported"`
+	// ContextParam is the number of exported functions taking a context.Context.
+	ContextParam int `json:"context_param"`
+	// Suffixed is the number of exported functions with the name suffix, e.g. WithContext.
+	Suffixed int `json:"suffixed"`
+	// Wrappers is the number of wrappers generated by the run.
+	Wrappers int `json:"wrappers"`
+}
+
+type packageStats struct {
+	Dir     string `json:"dir"`
+	Package string `json:"package"`
+	counts
+}
+
+// stats aggregates the counts of the inputs in total and by package.
+type stats struct {
+	counts
+	Packages []*packageStats `json:"packages"`
+
+	byKey map[string]*packageStats
+}
+
+func newStats() *stats {
+	return &stats{Packages: []*packageStats{}, byKey: make(map[string]*packageStats)}
+}
+
+func (s *stats) pkg(dir, name string) *packageStats {
+	key := dir + "\x00" + name
+	p, ok := s.byKey[key]
+	if !ok {
+		p = &packageStats{Dir: dir, Package: name}
+		s.byKey[key] = p
+		s.Packages = append(s.Packages, p)
+	}
+	return p
+}
+
+// addFunc counts the exported function fdecl of the package name in dir, declared in a file with imports,
+// whose context-aware functions have suffix.
+func (s *stats) addFunc(dir, name string, fdecl *ast.FuncDecl, imports map[string]importSpec, suffix string) {
+	if !fdecl.Name.IsExported() {
+		return
+	}
+	p := s.pkg(dir, name)
+	for _, c := range []*counts{&s.counts, &p.counts} {
+		c.Exported++
+		if hasContextParam(fdecl, imports) {
+			c.ContextParam++
+		}
+		if strings.HasSuffix(fdecl.Name.Name, suffix) && fdecl.Name.Name != suffix {
+			c.Suffixed++
+		}
+	}
+}
+
+// sourcePackage returns the directory and the name of the package declaring the function of t generated into out.
+func sourcePackage(fset *token.FileSet, out *output, t *target) (dir, name string) {
+	// The methods synthesized by -promote have no position, and are generated into their package.
+	pos := t.decl.Pos()
+	if !pos.IsValid() {
+		return out.displayDir, out.pkgName
+	}
+	name = out.srcName
+	if name == "" {
+		name = out.pkgName
+	}
+	return filepath.Dir(fset.Position(pos).Filename), name
+}
+
+// addWrappers counts the wrappers of outputs in the packages of the functions they wrap.
+func (s *stats) addWrappers(fset *token.FileSet, outputs []*output) {
+	for _, out := range outputs {
+		for _, t := range out.targets {
+			dir, name := sourcePackage(fset, out, t)
+			s.Wrappers++
+			s.pkg(dir, name).Wrappers++
+		}
+	}
+}
+
+// write writes s as indented JSON with the packages sorted by directory to the file at path,
+// or to the standard output for -.
+func (s *stats) write(path string) error {
+	sort.SliceStable(s.Packages, func(i, j int) bool { return s.Packages[i].Dir < s.Packages[j].Dir })
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		path = ""
+	}
+	return writeOutput(path, append(b, '\n'))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"strconv"
+)
+
+// trimImports removes the imports of the generated file src which are not referred to.
+// A qualifier declared locally, e.g. as a parameter, does not count as a use of the import.
+// The removed imports are logged as of the output name if verbose.
+func trimImports(src []byte, name string, verbose bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("parse generated code: %w", err)
+	}
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Obj == nil {
+				used[x.Name] = true
+			}
+		}
+		return true
+	})
+
+	trimmed := false
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		gdecl, ok := decl.(*ast.GenDecl)
+		if !ok || gdecl.Tok != token.IMPORT {
+			decls = append(decls, decl)
+			continue
+		}
+		specs := gdecl.Specs[:0]
+		for _, spec := range gdecl.Specs {
+			spec := spec.(*ast.ImportSpec)
+			path, _ := strconv.Unquote(spec.Path.Value)
+			qualifier := importName(path)
+			if spec.Name != nil {
+				qualifier = spec.Name.Name
+			}
+			if used[qualifier] || qualifier == "_" || qualifier == "." {
+				specs = append(specs, spec)
+				continue
+			}
+			trimmed = true
+			if verbose {
+				log.Printf("%s: trim unused import %q", name, path)
+			}
+		}
+		gdecl.Specs = specs
+		if len(specs) > 0 {
+			decls = append(decls, gdecl)
+		}
+	}
+	if !trimmed {
+		return src, nil
+	}
+	f.Decls = decls
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, fmt.Errorf("print trimmed code: %w", err)
+	}
+	return format.Source(buf.Bytes())
+}
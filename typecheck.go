@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// packageFiles parses the non-test Go files of the package pkgName in dir for the current build context.
+// The files whose absolute paths are in excluded are skipped.
+func packageFiles(fset *token.FileSet, dir, pkgName string, excluded map[string]bool) ([]*ast.File, error) {
+	infoList, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	var files []*ast.File
+	for _, info := range infoList {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		fpath, err := filepath.Abs(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("resolve source path: %w", err)
+		}
+		if excluded[fpath] {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, fpath, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		if f.Name.Name != pkgName {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// enclosingFunc returns the name of the function declaration in f containing pos.
+func enclosingFunc(f *ast.File, pos token.Pos) string {
+	for _, decl := range f.Decls {
+		fdecl, ok := decl.(*ast.FuncDecl)
+		if !ok || pos < fdecl.Pos() || fdecl.End() < pos {
+			continue
+		}
+		if fdecl.Recv != nil {
+			return "(" + types.ExprString(fdecl.Recv.List[0].Type) + ")." + fdecl.Name.Name
+		}
+		return fdecl.Name.Name
+	}
+	return ""
+}
+
+// typecheck type-checks the generated sources of outputs together with the packages they belong to.
+// The files in excluded, which are the outputs of a prior run, are left out of the packages.
+func typecheck(outputs []*output, excluded map[string]bool) error {
+	type pkgKey struct{ dir, name string }
+	pkgs := make(map[pkgKey][]*output)
+	var keys []pkgKey
+	for _, out := range outputs {
+		key := pkgKey{dir: out.dir, name: out.pkgName}
+		if _, ok := pkgs[key]; !ok {
+			keys = append(keys, key)
+		}
+		pkgs[key] = append(pkgs[key], out)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].dir < keys[j].dir })
+
+	var errs []string
+	for _, key := range keys {
+		fset := token.NewFileSet()
+		files, err := packageFiles(fset, key.dir, key.name, excluded)
+		if err != nil {
+			return fmt.Errorf("typecheck: %w", err)
+		}
+		genFiles := make(map[string]*ast.File)
+		for _, out := range pkgs[key] {
+			f, err := parser.ParseFile(fset, out.displayPath(), out.src, parser.SkipObjectResolution)
+			if err != nil {
+				return fmt.Errorf("typecheck: parse generated code: %w", err)
+			}
+			genFiles[out.displayPath()] = f
+			files = append(files, f)
+		}
+		conf := types.Config{
+			Importer: importer.ForCompiler(fset, "source", nil),
+			// The references to C are not checked, since they need cgo to process the preambles.
+			FakeImportC: true,
+			Error: func(err error) {
+				terr := err.(types.Error)
+				pos := terr.Fset.Position(terr.Pos)
+				if f, ok := genFiles[pos.Filename]; ok {
+					if name := enclosingFunc(f, terr.Pos); name != "" {
+						errs = append(errs, fmt.Sprintf("%s: wrapper %s: %s", pos, name, terr.Msg))
+						return
+					}
+				}
+				errs = append(errs, err.Error())
+			},
+		}
+		conf.Check(key.dir, fset, files, nil)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("typecheck failed:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"strings"
+)
+
+// wrapExprDummies substitutes the placeholders of -wrap-expr to validate the template.
+var wrapExprDummies = map[byte]string{'n': "Name", 'f': "f", 'c': "c", 'a': "a"}
+
+// expandWrapExpr substitutes the placeholders in the -wrap-expr template tmpl:
+//
+//	%n  the name of the wrapper, e.g. Foo (quote it to get a string literal)
+//	%f  the wrapped function, e.g. FooWithContext or s.FooWithContext
+//	%c  the context expression, e.g. context.Background()
+//	%a  the forwarded arguments separated by commas, spreading a variadic one
+//	%%  a literal %
+func expandWrapExpr(tmpl string, values map[byte]string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' {
+			b.WriteByte(tmpl[i])
+			continue
+		}
+		i++
+		if i == len(tmpl) {
+			return "", fmt.Errorf("trailing %%")
+		}
+		if tmpl[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		v, ok := values[tmpl[i]]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder %%%c", tmpl[i])
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// parseWrapExpr validates the -wrap-expr template tmpl and returns the package qualifiers it refers to.
+func parseWrapExpr(tmpl string) ([]string, error) {
+	src, err := expandWrapExpr(tmpl, wrapExprDummies)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %w", src, err)
+	}
+	return templateQualifiers(expr), nil
+}
+
+// templateQualifiers returns the package qualifiers referred to by node parsed from a template expanded with wrapExprDummies.
+func templateQualifiers(node ast.Node) []string {
+	var names []string
+	ast.Inspect(node, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name != wrapExprDummies['f'] && x.Name != wrapExprDummies['c'] && x.Name != wrapExprDummies['a'] {
+				names = append(names, x.Name)
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// parseStmts parses src as a list of statements.
+func parseStmts(src string) ([]ast.Stmt, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\nfunc _() {\n"+src+"\n}", parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	stmts := f.Decls[0].(*ast.FuncDecl).Body.List
+	for _, stmt := range stmts {
+		resetPos(stmt)
+	}
+	return stmts, nil
+}
+
+// parseDeprecateStmt validates the -deprecate-expr template tmpl and returns the package qualifiers it refers to.
+// It is a list of statements with the placeholders %n and %f of -wrap-expr.
+func parseDeprecateStmt(tmpl string) ([]string, error) {
+	src, err := expandWrapExpr(tmpl, map[byte]string{'n': wrapExprDummies['n'], 'f': wrapExprDummies['f']})
+	if err != nil {
+		return nil, err
+	}
+	stmts, err := parseStmts(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %w", src, err)
+	}
+	if len(stmts) == 0 {
+		return nil, fmt.Errorf("%q has no statements", src)
+	}
+	var names []string
+	for _, stmt := range stmts {
+		names = append(names, templateQualifiers(stmt)...)
+	}
+	return names, nil
+}
+
+// deprecateStmts returns the statements of the -deprecate-expr template tmpl for the wrapper named name calling fun.
+func deprecateStmts(tmpl, name string, fun ast.Expr, names stdNames) ([]ast.Stmt, error) {
+	src, err := expandWrapExpr(tmpl, map[byte]string{'n': name, 'f': types.ExprString(fun)})
+	if err != nil {
+		return nil, err
+	}
+	stmts, err := parseStmts(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse -deprecate-expr of %s: %w", name, err)
+	}
+	for _, stmt := range stmts {
+		renameQualifier(contextPath, names.context, stmt)
+	}
+	return stmts, nil
+}
+
+// resetPos clears the positions under node, which are meaningless in the file set of the sources
+// when node is parsed separately. The ellipsis of a call spreading its last argument is kept valid,
+// as forwardArgs sets it, since the printer omits it otherwise.
+func resetPos(node ast.Node) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(node, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		call, spread := n.(*ast.CallExpr)
+		spread = spread && call.Ellipsis.IsValid()
+		v := reflect.ValueOf(n).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Type() == posType {
+				f.SetInt(int64(token.NoPos))
+			}
+		}
+		if spread {
+			call.Ellipsis = 1
+		}
+		return true
+	})
+}
+
+// wrapCall builds the expression of the -wrap-expr template for the wrapper named name,
+// which would otherwise evaluate call passing the context as the argument ctxArg.
+// A variadic parameter is spread by %a, which must therefore end the arguments of a call.
+func wrapCall(tmpl, name string, call *ast.CallExpr, ctxArg int, names stdNames) (ast.Expr, error) {
+	args := make([]string, 0, len(call.Args)-1)
+	for i, arg := range call.Args {
+		if i != ctxArg {
+			args = append(args, types.ExprString(arg))
+		}
+	}
+	if call.Ellipsis.IsValid() && len(args) > 0 {
+		args[len(args)-1] += "..."
+	}
+	src, err := expandWrapExpr(tmpl, map[byte]string{
+		'n': name,
+		'f': types.ExprString(call.Fun),
+		'c': types.ExprString(call.Args[ctxArg]),
+		'a': strings.Join(args, ", "),
+	})
+	if err != nil {
+		return nil, err
+	}
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse -wrap-expr of %s: %w", name, err)
+	}
+	resetPos(expr)
+	renameQualifier(contextPath, names.context, expr)
+	return expr, nil
+}